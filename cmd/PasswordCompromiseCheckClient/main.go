@@ -3,33 +3,39 @@ package main
 import (
 	"flag"
 	"fmt"
+	"strings"
 
 	"github.com/petrkamnev/password-compromise-check-server/pkg/PasswordCompromiseCheckClientLib"
 )
 
 func main() {
-	mode := flag.String("mode", "sha1", "The mode of the server (\"sha1\", \"ntlm\", \"psi\")")
+	modes := []string{}
+	for _, name := range PasswordCompromiseCheckClientLib.HashFunctionNames() {
+		modes = append(modes, "\""+name+"\"", "\"psi-"+name+"\"")
+	}
+	mode := flag.String("mode", PasswordCompromiseCheckClientLib.DefaultHashFunction, "The mode of the server ("+strings.Join(modes, ", ")+", \"psi\" for \"psi-"+PasswordCompromiseCheckClientLib.DefaultHashFunction+"\")")
 	password := flag.String("password", "", "The password to check")
 	url := flag.String("url", "", "The password compromise check server url")
 	flag.Parse()
-	if *mode == "sha1" {
-		result, err := PasswordCompromiseCheckClientLib.CheckSHA1Password(*password, *url)
-		if err != nil {
-			fmt.Println("Error checking password:", err)
-			return
-		}
-		fmt.Println(result)
-	} else if *mode == "ntlm" {
-	} else if *mode == "psi" {
-		result, err := PasswordCompromiseCheckClientLib.CheckSHA1PSIPassword(*password, *url)
-		if err != nil {
-			fmt.Println("Error checking password:", err)
-			return
-		}
-		fmt.Println(result)
-	} else {
+
+	check := PasswordCompromiseCheckClientLib.CheckPassword
+	hashFunction := *mode
+	if *mode == "psi" {
+		check = PasswordCompromiseCheckClientLib.CheckPSIPassword
+		hashFunction = PasswordCompromiseCheckClientLib.DefaultHashFunction
+	} else if name, found := strings.CutPrefix(*mode, "psi-"); found {
+		check = PasswordCompromiseCheckClientLib.CheckPSIPassword
+		hashFunction = name
+	}
+	if _, ok := PasswordCompromiseCheckClientLib.LookupHashFunction(hashFunction); !ok {
 		flag.Usage()
 		return
 	}
 
+	result, err := check(hashFunction, *password, *url)
+	if err != nil {
+		fmt.Println("Error checking password:", err)
+		return
+	}
+	fmt.Println(result)
 }
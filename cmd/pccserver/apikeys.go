@@ -0,0 +1,254 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// The API keys are sent in the "hibp-api-key" header, as by the HIBP clients. Only the SHA-256 hashes
+// of the keys are kept, in apikeys.json next to state.json. A key may be limited to some hash functions
+// and protocols, no limit means all of them.
+const apiKeyHeader = "hibp-api-key"
+
+// APIKey describes an API key accepted by run-server
+type APIKey struct {
+	ID string `json:"id"`
+	// Hex SHA-256 hash of the key
+	Hash          string    `json:"hash"`
+	Name          string    `json:"name,omitempty"`
+	HashFunctions []string  `json:"hash_functions,omitempty"`
+	Protocols     []string  `json:"protocols,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+var apiKeyCmd = &cobra.Command{
+	Use:   "apikey",
+	Short: "Manage the API keys",
+	Long:  `Manage the API keys which run-server accepts in the "hibp-api-key" header with "require-api-key".`,
+}
+
+var apiKeyCreateCmd = &cobra.Command{
+	Use:   "create",
+	Short: "Create an API key",
+	Long:  `Create an API key and output it. Only its hash is stored, so the key cannot be output again.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		name, _ := cmd.Flags().GetString("name")
+		hashFunctions, _ := cmd.Flags().GetStringSlice("hash-functions")
+		for _, hashFunction := range hashFunctions {
+			if err := validateHashFunction(hashFunction); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+		}
+		var protocols []string
+		protocolsValue, _ := cmd.Flags().GetString("protocols")
+		if protocolsValue != "" {
+			var err error
+			protocols, err = parseProtocols(protocolsValue)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+		}
+
+		lock, err := lockStorage(cmd)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		defer lock.unlock()
+		keys, err := readAPIKeys()
+		if err != nil {
+			fmt.Printf("Error reading API keys: %v\n", err)
+			return
+		}
+		key, err := randomHex(32)
+		if err == nil {
+			var id string
+			id, err = randomHex(4)
+			keys = append(keys, APIKey{
+				ID:            id,
+				Hash:          hashAPIKey(key),
+				Name:          name,
+				HashFunctions: hashFunctions,
+				Protocols:     protocols,
+				CreatedAt:     time.Now().UTC(),
+			})
+			if err == nil {
+				err = writeAPIKeys(keys)
+			}
+			if err == nil {
+				fmt.Printf("Created API key %s: %s\n", id, key)
+			}
+		}
+		if err != nil {
+			fmt.Printf("Error creating API key: %v\n", err)
+		}
+	},
+}
+
+var apiKeyRevokeCmd = &cobra.Command{
+	Use:   "revoke ID...",
+	Short: "Revoke the API keys",
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		lock, err := lockStorage(cmd)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		defer lock.unlock()
+		keys, err := readAPIKeys()
+		if err != nil {
+			fmt.Printf("Error reading API keys: %v\n", err)
+			return
+		}
+		for _, id := range args {
+			found := false
+			for i, key := range keys {
+				if key.ID == id {
+					keys = append(keys[:i], keys[i+1:]...)
+					found = true
+					break
+				}
+			}
+			if !found {
+				fmt.Printf("Error: no API key %s\n", id)
+				return
+			}
+		}
+		if err := writeAPIKeys(keys); err != nil {
+			fmt.Printf("Error revoking API keys: %v\n", err)
+		}
+	},
+}
+
+var apiKeyListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "Output the API keys",
+	Run: func(cmd *cobra.Command, args []string) {
+		keys, err := readAPIKeys()
+		if err != nil {
+			fmt.Printf("Error reading API keys: %v\n", err)
+			return
+		}
+		for _, key := range keys {
+			hashFunctions, protocols := "all", "all"
+			if len(key.HashFunctions) > 0 {
+				hashFunctions = strings.Join(key.HashFunctions, ", ")
+			}
+			if len(key.Protocols) > 0 {
+				protocols = strings.Join(key.Protocols, ", ")
+			}
+			fmt.Printf("%s %q, hash functions: %s, protocols: %s (created %s)\n", key.ID, key.Name, hashFunctions, protocols, key.CreatedAt.Format(time.RFC3339))
+		}
+	},
+}
+
+func initAPIKeyCmd() {
+	apiKeyCreateCmd.Flags().String("name", "", "Name describing the holder of the key")
+	apiKeyCreateCmd.Flags().StringSlice("hash-functions", nil, "Comma-separated hash functions the key may query (by default all): "+hashFunctionsList())
+	apiKeyCreateCmd.Flags().String("protocols", "", "Comma-separated protocols the key may use (by default all): \"hash\", \"psi\"")
+	apiKeyCmd.AddCommand(apiKeyCreateCmd)
+	apiKeyCmd.AddCommand(apiKeyRevokeCmd)
+	apiKeyCmd.AddCommand(apiKeyListCmd)
+}
+
+func getAPIKeysPath() string {
+	return filepath.Join(getStoragePath(), "apikeys.json")
+}
+
+func readAPIKeys() ([]APIKey, error) {
+	file, err := os.Open(getAPIKeysPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []APIKey{}, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+	keys := []APIKey{}
+	if err := json.NewDecoder(file).Decode(&keys); err != nil {
+		return nil, fmt.Errorf("failed to decode API keys file: %v", err)
+	}
+	return keys, nil
+}
+
+func writeAPIKeys(keys []APIKey) error {
+	if err := writeJSONFile(getAPIKeysPath(), keys); err != nil {
+		return fmt.Errorf("failed to write API keys file: %v", err)
+	}
+	return nil
+}
+
+func randomHex(size int) (string, error) {
+	data := make([]byte, size)
+	if _, err := rand.Read(data); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(data), nil
+}
+
+func hashAPIKey(key string) string {
+	digest := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(digest[:])
+}
+
+// allows reports whether the key may query the hash function with the protocol
+func (key *APIKey) allows(mode, protocol string) bool {
+	return (len(key.HashFunctions) == 0 || containsString(key.HashFunctions, mode)) &&
+		(len(key.Protocols) == 0 || containsString(key.Protocols, protocol))
+}
+
+func containsString(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
+
+// requireAPIKey serves the requests of the protocol only with an API key allowing it. The keys are
+// taken from the served snapshot, so the created and revoked keys apply once it is reloaded.
+func requireAPIKey(protocol string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		value := r.Header.Get(apiKeyHeader)
+		if value == "" {
+			writeAPIError(w, http.StatusUnauthorized, "Access denied due to missing hibp-api-key.")
+			return
+		}
+		dataset := served.acquire()
+		key, found := dataset.apiKeys[hashAPIKey(value)]
+		dataset.release()
+		if !found {
+			writeAPIError(w, http.StatusUnauthorized, "Access denied due to invalid hibp-api-key.")
+			return
+		}
+		if mode := getRequestMode(r); !key.allows(mode, protocol) {
+			writeAPIError(w, http.StatusForbidden, fmt.Sprintf("The hibp-api-key does not allow the %s protocol with the '%s' hash function.", protocol, mode))
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// writeAPIError responds with an error in the HIBP format
+func writeAPIError(w http.ResponseWriter, statusCode int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(struct {
+		StatusCode int    `json:"statusCode"`
+		Message    string `json:"message"`
+	}{statusCode, message})
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/xattr"
+)
+
+// Storage is a backend holding the compromised password records of a single hash function.
+// Prefixes are 5-char uppercase hex strings, suffixes are the remaining uppercase hex chars of the hash.
+type Storage interface {
+	// GetRange returns the records of the prefix, errPrefixNotFound if the prefix is absent
+	GetRange(prefix string) ([]HashRecord, error)
+	// LookupSuffix returns the count of the suffix in the prefix or 0 if the suffix is absent
+	LookupSuffix(prefix, suffix string) (uint64, error)
+	// PutRange replaces the records of the prefix
+	PutRange(prefix string, records []HashRecord, metadata PrefixMetadata) error
+	// ListPrefixes returns the sorted list of the stored prefixes
+	ListPrefixes() ([]string, error)
+	// Metadata returns the caching metadata of the prefix
+	Metadata(prefix string) (PrefixMetadata, error)
+	Close() error
+}
+
+// HashRecord is a single "SUFFIX:COUNT" record of a range
+type HashRecord struct {
+	Suffix string
+	Count  uint64
+}
+
+// PrefixMetadata holds the values of the caching headers of a range
+type PrefixMetadata struct {
+	ETag         string
+	LastModified time.Time
+}
+
+var errPrefixNotFound = errors.New("the hash prefix was not found")
+
+// openStorage opens the storage of the mode in the data directory: the packed file if it has been built, the prefix files otherwise
+func openStorage(dataPath, mode string) (Storage, error) {
+	packedPath := getPackedStoragePath(dataPath, mode)
+	if _, err := os.Stat(packedPath); err == nil {
+		return openPackedStorage(packedPath)
+	}
+	return newDirectoryStorage(dataPath, mode), nil
+}
+
+// formatRange renders the records in the HIBP response format
+func formatRange(records []HashRecord) string {
+	lines := make([]string, len(records))
+	for i, record := range records {
+		lines[i] = record.Suffix + ":" + strconv.FormatUint(record.Count, 10)
+	}
+	return strings.Join(lines, "\r\n")
+}
+
+// parseRange reads "SUFFIX:COUNT" lines, skipping the malformed ones
+func parseRange(reader io.Reader) ([]HashRecord, error) {
+	var records []HashRecord
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		parts := strings.Split(strings.TrimSpace(scanner.Text()), ":")
+		if len(parts) != 2 {
+			continue
+		}
+		count, err := strconv.ParseUint(parts[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		records = append(records, HashRecord{Suffix: strings.ToUpper(parts[0]), Count: count})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// parseValidatedRange parses a range requiring every line to be a "SUFFIX:COUNT" record
+// with a hex suffix of the given length
+func parseValidatedRange(data []byte, suffixLength int) ([]HashRecord, error) {
+	var records []HashRecord
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if line == "" {
+			continue
+		}
+		suffix, countValue, found := strings.Cut(line, ":")
+		if !found || len(suffix) != suffixLength || !isHexString(suffix) {
+			return nil, fmt.Errorf("invalid record on line %d: %q", i+1, line)
+		}
+		count, err := strconv.ParseUint(countValue, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid count on line %d: %q", i+1, line)
+		}
+		records = append(records, HashRecord{Suffix: strings.ToUpper(suffix), Count: count})
+	}
+	return records, nil
+}
+
+func isHexString(value string) bool {
+	for _, c := range value {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F') {
+			return false
+		}
+	}
+	return true
+}
+
+// directoryStorage keeps one "PREFIX.txt" file per prefix in the <data>/<mode> directory.
+// ETags are kept in the "user.etag" extended attribute, Last-Modified is the file modification time,
+// or both are kept in the sidecar index (see metadata.go).
+type directoryStorage struct {
+	directory string
+	// Sidecar index of the caching metadata, nil if the extended attributes are used
+	sidecar *sidecarMetadataStore
+}
+
+// newDirectoryStorage opens the prefix files of the mode in the data directory for reading
+func newDirectoryStorage(dataPath, mode string) *directoryStorage {
+	return &directoryStorage{
+		directory: filepath.Join(dataPath, getHashFunctionFolder(mode)),
+		sidecar:   getSidecarMetadataStore(dataPath, mode, false),
+	}
+}
+
+// newWritableDirectoryStorage opens the prefix files of the mode in the data directory for writing
+func newWritableDirectoryStorage(dataPath, mode string) *directoryStorage {
+	return &directoryStorage{
+		directory: filepath.Join(dataPath, getHashFunctionFolder(mode)),
+		sidecar:   getSidecarMetadataStore(dataPath, mode, true),
+	}
+}
+
+func (storage *directoryStorage) prefixPath(prefix string) string {
+	return filepath.Join(storage.directory, prefix+".txt")
+}
+
+func (storage *directoryStorage) GetRange(prefix string) ([]HashRecord, error) {
+	file, err := os.Open(storage.prefixPath(prefix))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errPrefixNotFound
+		}
+		return nil, fmt.Errorf("failed to open file: %v", err)
+	}
+	defer file.Close()
+
+	records, err := parseRange(file)
+	if err != nil {
+		return nil, fmt.Errorf("error reading file: %v", err)
+	}
+	return records, nil
+}
+
+func (storage *directoryStorage) LookupSuffix(prefix, suffix string) (uint64, error) {
+	records, err := storage.GetRange(prefix)
+	if err != nil {
+		if err == errPrefixNotFound {
+			return 0, nil
+		}
+		return 0, err
+	}
+	for _, record := range records {
+		if record.Suffix == suffix {
+			return record.Count, nil
+		}
+	}
+	return 0, nil
+}
+
+func (storage *directoryStorage) PutRange(prefix string, records []HashRecord, metadata PrefixMetadata) error {
+	return storage.putRawRange(prefix, []byte(formatRange(records)), metadata)
+}
+
+// putRawRange writes the range in the HIBP response format to a temporary file and renames it into place,
+// so the files hard-linked from other generations are never modified
+func (storage *directoryStorage) putRawRange(prefix string, data []byte, metadata PrefixMetadata) error {
+	if err := os.MkdirAll(storage.directory, 0755); err != nil {
+		return fmt.Errorf("Failed to create directory: %v", err)
+	}
+	filename := storage.prefixPath(prefix)
+	tmpFilename := filename + ".tmp"
+	file, err := os.Create(tmpFilename)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFilename)
+	defer file.Close()
+
+	if _, err := file.Write(data); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	lastModified := metadata.LastModified
+	if lastModified.IsZero() {
+		lastModified = time.Now()
+	}
+	if err := os.Chtimes(tmpFilename, lastModified, lastModified); err != nil {
+		return err
+	}
+
+	if metadata.ETag != "" && storage.sidecar == nil {
+		if err := xattr.Set(tmpFilename, "user.etag", []byte(metadata.ETag)); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(tmpFilename, filename); err != nil {
+		return err
+	}
+	if storage.sidecar != nil {
+		return storage.sidecar.put(prefix, sidecarEntry{
+			ETag:         metadata.ETag,
+			LastModified: lastModified,
+		})
+	}
+	return nil
+}
+
+func (storage *directoryStorage) ListPrefixes() ([]string, error) {
+	entries, err := os.ReadDir(storage.directory)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []string{}, nil
+		}
+		return nil, err
+	}
+	prefixes := []string{}
+	for _, entry := range entries {
+		prefix, found := strings.CutSuffix(entry.Name(), ".txt")
+		if !found {
+			continue
+		}
+		if _, err := parsePrefix(prefix); err == nil {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	sort.Strings(prefixes)
+	return prefixes, nil
+}
+
+func (storage *directoryStorage) Metadata(prefix string) (PrefixMetadata, error) {
+	filename := storage.prefixPath(prefix)
+	fileInfo, err := os.Stat(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return PrefixMetadata{}, errPrefixNotFound
+		}
+		return PrefixMetadata{}, err
+	}
+	metadata := PrefixMetadata{LastModified: fileInfo.ModTime()}
+	if storage.sidecar != nil {
+		entry, found, err := storage.sidecar.get(prefix)
+		if err != nil {
+			return PrefixMetadata{}, err
+		}
+		if found {
+			metadata.ETag = entry.ETag
+			metadata.LastModified = entry.LastModified
+		}
+		return metadata, nil
+	}
+	if etag, err := xattr.Get(filename, "user.etag"); err == nil {
+		metadata.ETag = string(etag)
+	}
+	return metadata, nil
+}
+
+func (storage *directoryStorage) Close() error {
+	if storage.sidecar != nil {
+		return storage.sidecar.close()
+	}
+	return nil
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/petrkamnev/password-compromise-check-server/pkg/PasswordCompromiseCheckClientLib"
+	"github.com/spf13/cobra"
+)
+
+// The backup archive is a zstd-compressed tar of the current generation:
+//
+//	state.json                        state of the storage (hash functions and their datasets)
+//	<folder>.manifest[.sig]           checksum manifest of the hash function and its signature
+//	<folder>.pack                     packed storage of the hash function
+//	<folder>/<PREFIX>.txt             prefix files of the hash functions which are not packed, Last-Modified
+//	                                  is the modification time, the ETag is kept in the "SCHILY.xattr.user.etag"
+//	                                  PAX record
+//
+// The restored archive is verified against its manifests before it is activated as a new generation.
+const (
+	backupStateName  = "state.json"
+	backupETagRecord = "SCHILY.xattr.user.etag"
+)
+
+var backupCmd = &cobra.Command{
+	Use:   "backup",
+	Short: "Back up the served storage into a single archive",
+	Long:  `Write the values, the caching metadata, the checksum manifests and the state of the current generation into a zstd-compressed tar archive.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		// The lock keeps the imports, pruning and rollbacks from removing the generation while it is archived
+		lock, err := lockStorage(cmd)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		defer lock.unlock()
+		output, _ := cmd.Flags().GetString("output")
+		if err := backupStorage(output); err != nil {
+			fmt.Printf("Error backing up storage: %v\n", err)
+			os.Remove(output)
+			os.Exit(1)
+		}
+		if !quietFlag {
+			fmt.Printf("The storage is backed up to %s\n", output)
+		}
+	},
+}
+
+var restoreCmd = &cobra.Command{
+	Use:   "restore",
+	Short: "Restore the storage from a backup archive",
+	Long:  `Extract a backup archive into a new generation, verify it against its checksum manifests and switch to it.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		lock, err := lockStorage(cmd)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		defer lock.unlock()
+		input, _ := cmd.Flags().GetString("input")
+		if err := restoreStorage(input); err != nil {
+			fmt.Printf("Error restoring storage: %v\n", err)
+			os.Exit(1)
+		}
+		if !quietFlag {
+			state, err := readStateFile()
+			if err == nil {
+				fmt.Printf("Restored generation: %s\n", state.CurrentGeneration)
+			}
+		}
+	},
+}
+
+func initBackupCmds() {
+	backupCmd.Flags().StringP("output", "o", "", "Backup archive file (.tar.zst)")
+	backupCmd.MarkFlagRequired("output")
+	restoreCmd.Flags().StringP("input", "i", "", "Backup archive file (.tar.zst)")
+	restoreCmd.MarkFlagRequired("input")
+}
+
+// backupStorage archives the current generation into the output file
+func backupStorage(output string) error {
+	state, err := readStateFile()
+	if err != nil {
+		return fmt.Errorf("failed to read state file: %v", err)
+	}
+	if len(state.SupportedHashFunctions) == 0 {
+		return fmt.Errorf("no hash functions are imported")
+	}
+	// The generation is resolved once, so the archive holds a single generation
+	dataPath, err := filepath.EvalSymlinks(getDataPath())
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	encoder, err := zstd.NewWriter(file)
+	if err != nil {
+		return err
+	}
+	defer encoder.Close()
+	archive := tar.NewWriter(encoder)
+
+	stateData, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode state: %v", err)
+	}
+	if err := writeArchiveFile(archive, backupStateName, stateData, time.Now(), ""); err != nil {
+		return err
+	}
+	for _, mode := range state.SupportedHashFunctions {
+		if !quietFlag {
+			fmt.Printf("Backing up %s storage...\n", mode)
+		}
+		if err := backupHashFunction(archive, dataPath, mode); err != nil {
+			return fmt.Errorf("failed to back up %s storage: %v", mode, err)
+		}
+	}
+
+	if err := archive.Close(); err != nil {
+		return err
+	}
+	if err := encoder.Close(); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// backupHashFunction archives the manifest and the packed file of the mode, or its prefix files if it is
+// not packed. The values are checked against the manifest, so a corrupted storage is not backed up.
+func backupHashFunction(archive *tar.Writer, dataPath, mode string) error {
+	manifest, err := readManifest(dataPath, mode)
+	if err != nil {
+		return err
+	}
+	if manifest == nil {
+		return fmt.Errorf("there is no checksum manifest, run \"verify-storage\" and import the values again")
+	}
+	packedPath := getPackedStoragePath(dataPath, mode)
+	_, err = os.Stat(packedPath)
+	packed := err == nil
+	for _, path := range []string{getManifestPath(dataPath, mode), getManifestSignaturePath(dataPath, mode), packedPath} {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			continue
+		}
+		if err := copyArchiveFile(archive, path, filepath.Base(path)); err != nil {
+			return err
+		}
+	}
+
+	// The values are read the same way as when the manifest was written, from the packed file if there is one
+	storage, err := openStorage(dataPath, mode)
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+	prefixes, err := storage.ListPrefixes()
+	if err != nil {
+		return err
+	}
+	folder := getHashFunctionFolder(mode)
+	for _, prefix := range prefixes {
+		data, err := readRawRange(storage, prefix)
+		if err != nil {
+			return fmt.Errorf("failed to read prefix %s: %v", prefix, err)
+		}
+		if checksum := rangeChecksum(data); checksum != manifest[prefix] {
+			return fmt.Errorf("prefix %s does not match the checksum manifest, run \"verify-storage --repair\" first", prefix)
+		}
+		// The packed values are archived in the packed file
+		if packed {
+			continue
+		}
+		metadata, err := storage.Metadata(prefix)
+		if err != nil {
+			return err
+		}
+		if err := writeArchiveFile(archive, folder+"/"+prefix+".txt", data, metadata.LastModified, metadata.ETag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeArchiveFile(archive *tar.Writer, name string, data []byte, modTime time.Time, etag string) error {
+	header := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     int64(len(data)),
+		Mode:     0644,
+		ModTime:  modTime,
+		Format:   tar.FormatPAX,
+	}
+	if etag != "" {
+		header.PAXRecords = map[string]string{backupETagRecord: etag}
+	}
+	if err := archive.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := archive.Write(data)
+	return err
+}
+
+func copyArchiveFile(archive *tar.Writer, path, name string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	header := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     fileInfo.Size(),
+		Mode:     0644,
+		ModTime:  fileInfo.ModTime(),
+		Format:   tar.FormatPAX,
+	}
+	if err := archive.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err = io.Copy(archive, file)
+	return err
+}
+
+// restoreStorage extracts the archive into a new generation, verifies it and activates it
+func restoreStorage(input string) error {
+	state, err := readStateFile()
+	if err != nil {
+		return fmt.Errorf("failed to read state file: %v", err)
+	}
+	if state.PendingImport != nil {
+		return fmt.Errorf("an interrupted import is pending, finish it with \"import-values --resume\" first")
+	}
+
+	generation, err := createEmptyGeneration()
+	if err != nil {
+		return err
+	}
+	generationPath := getGenerationPath(generation)
+	archivedState, err := extractBackup(input, generationPath)
+	if err != nil {
+		discardGeneration(generation)
+		return err
+	}
+	if err := verifyRestoredGeneration(generationPath, archivedState); err != nil {
+		discardGeneration(generation)
+		return err
+	}
+	if err := activateRestoredGeneration(generation, archivedState); err != nil {
+		discardGeneration(generation)
+		return err
+	}
+	return nil
+}
+
+// extractBackup extracts the archive into the generation directory and returns the archived state
+func extractBackup(input, generationPath string) (*State, error) {
+	file, err := os.Open(input)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	decoder, err := zstd.NewReader(file)
+	if err != nil {
+		return nil, err
+	}
+	defer decoder.Close()
+	archive := tar.NewReader(decoder)
+
+	var archivedState *State
+	folders := map[string]string{}
+	for _, mode := range PasswordCompromiseCheckClientLib.HashFunctionNames() {
+		folders[getHashFunctionFolder(mode)] = mode
+	}
+	storages := map[string]*directoryStorage{}
+	defer func() {
+		for _, storage := range storages {
+			storage.Close()
+		}
+	}()
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read archive: %v", err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		if header.Name == backupStateName {
+			archivedState = &State{}
+			if err := json.NewDecoder(archive).Decode(archivedState); err != nil {
+				return nil, fmt.Errorf("failed to decode the archived state: %v", err)
+			}
+			continue
+		}
+		// Only the files of the registered hash functions are extracted, so the archive cannot write outside the generation
+		folder, name, isPrefixFile := strings.Cut(header.Name, "/")
+		if isPrefixFile {
+			mode, found := folders[folder]
+			prefix, isText := strings.CutSuffix(name, ".txt")
+			if !found || !isText || len(prefix) != 5 || !isHexString(prefix) {
+				return nil, fmt.Errorf("unexpected archive entry: %s", header.Name)
+			}
+			if storages[mode] == nil {
+				storages[mode] = newWritableDirectoryStorage(generationPath, mode)
+			}
+			data, err := io.ReadAll(archive)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read archive: %v", err)
+			}
+			metadata := PrefixMetadata{ETag: header.PAXRecords[backupETagRecord], LastModified: header.ModTime}
+			if err := storages[mode].putRawRange(strings.ToUpper(prefix), data, metadata); err != nil {
+				return nil, fmt.Errorf("failed to restore %s: %v", header.Name, err)
+			}
+			continue
+		}
+		base := strings.TrimSuffix(strings.TrimSuffix(strings.TrimSuffix(header.Name, ".sig"), ".manifest"), ".pack")
+		if _, found := folders[base]; !found || base == header.Name {
+			return nil, fmt.Errorf("unexpected archive entry: %s", header.Name)
+		}
+		if err := extractArchiveFile(archive, filepath.Join(generationPath, header.Name), header.ModTime); err != nil {
+			return nil, fmt.Errorf("failed to restore %s: %v", header.Name, err)
+		}
+	}
+	if archivedState == nil {
+		return nil, fmt.Errorf("the archive does not contain %s", backupStateName)
+	}
+	// The storages are closed before the generation is verified, so their sidecar metadata is written out
+	for mode, storage := range storages {
+		delete(storages, mode)
+		if err := storage.Close(); err != nil {
+			return nil, fmt.Errorf("failed to write %s metadata: %v", mode, err)
+		}
+	}
+	return archivedState, nil
+}
+
+func extractArchiveFile(reader io.Reader, path string, modTime time.Time) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := io.Copy(file, reader); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Chtimes(path, modTime, modTime)
+}
+
+// verifyRestoredGeneration checks the restored storages of the archived hash functions against their manifests
+func verifyRestoredGeneration(generationPath string, archivedState *State) error {
+	if len(archivedState.SupportedHashFunctions) == 0 {
+		return fmt.Errorf("the archive does not contain any hash functions")
+	}
+	for _, mode := range archivedState.SupportedHashFunctions {
+		if err := validateHashFunction(mode); err != nil {
+			return fmt.Errorf("unsupported hash function %s in the archive", mode)
+		}
+		if _, err := os.Stat(getManifestPath(generationPath, mode)); err != nil {
+			return fmt.Errorf("the archive does not contain the %s checksum manifest", mode)
+		}
+		if !quietFlag {
+			fmt.Printf("Verifying restored %s storage...\n", mode)
+		}
+		bad, err := verifyStorage(generationPath, mode)
+		if err != nil {
+			return fmt.Errorf("failed to verify %s storage: %v", mode, err)
+		}
+		if len(bad) > 0 {
+			printBadPrefixes(mode, bad)
+			return fmt.Errorf("the restored %s storage does not match its checksum manifest", mode)
+		}
+	}
+	return nil
+}
+
+// activateRestoredGeneration switches to the restored generation, which serves only the archived hash functions
+func activateRestoredGeneration(id string, archivedState *State) error {
+	datasets := map[string]Dataset{}
+	for _, mode := range archivedState.SupportedHashFunctions {
+		dataset := archivedState.Datasets[mode]
+		if err := scanDataset(&dataset, getGenerationPath(id), mode); err != nil {
+			return fmt.Errorf("failed to collect %s dataset statistics: %v", mode, err)
+		}
+		datasets[mode] = dataset
+	}
+
+	state, err := readStateFile()
+	if err != nil {
+		return fmt.Errorf("failed to read state file: %v", err)
+	}
+	generation := Generation{
+		ID:            id,
+		CreatedAt:     time.Now().UTC(),
+		HashFunctions: append([]string{}, archivedState.SupportedHashFunctions...),
+		Datasets:      datasets,
+	}
+	state.Generations = append(state.Generations, generation)
+	return switchGeneration(state, generation)
+}
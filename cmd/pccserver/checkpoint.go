@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PendingImport describes an import whose generation has not been activated yet
+type PendingImport struct {
+	Generation   string    `json:"generation,omitempty"`
+	Source       string    `json:"source,omitempty"`
+	HashFunction string    `json:"hash_function"`
+	URL          string    `json:"url"`
+	MinCount     uint64    `json:"min_count,omitempty"`
+	StartedAt    time.Time `json:"started_at"`
+}
+
+// importJournal is an append-only checkpoint of the prefixes processed by an API import.
+// Each line is either "done PREFIX" or "failed PREFIX message".
+type importJournal struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// getImportJournalPath returns the journal path in the directory the import writes into
+func getImportJournalPath(dataPath string) string {
+	return filepath.Join(dataPath, "import.journal")
+}
+
+// openImportJournal opens the journal of the import data directory for appending and returns
+// the prefixes already completed and the ones which failed (with the last error)
+func openImportJournal(dataPath string) (*importJournal, map[int]bool, map[int]string, error) {
+	path := getImportJournalPath(dataPath)
+	completed := map[int]bool{}
+	failed := map[int]string{}
+
+	file, err := os.Open(path)
+	if err == nil {
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			// An interrupted import can leave a partial last line, which is ignored
+			fields := strings.SplitN(scanner.Text(), " ", 3)
+			if len(fields) < 2 {
+				continue
+			}
+			prefix, err := parsePrefix(fields[1])
+			if err != nil {
+				continue
+			}
+			switch fields[0] {
+			case "done":
+				completed[prefix] = true
+				delete(failed, prefix)
+			case "failed":
+				if len(fields) == 3 {
+					failed[prefix] = fields[2]
+				} else {
+					failed[prefix] = ""
+				}
+			}
+		}
+		file.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to read import journal: %v", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, nil, nil, fmt.Errorf("failed to open import journal: %v", err)
+	}
+
+	file, err = os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to open import journal: %v", err)
+	}
+	return &importJournal{file: file}, completed, failed, nil
+}
+
+func (journal *importJournal) markDone(prefix int) error {
+	return journal.append(fmt.Sprintf("done %05X\n", prefix))
+}
+
+func (journal *importJournal) markFailed(prefix int, err error) error {
+	message := strings.ReplaceAll(err.Error(), "\n", " ")
+	return journal.append(fmt.Sprintf("failed %05X %s\n", prefix, message))
+}
+
+func (journal *importJournal) append(line string) error {
+	journal.mu.Lock()
+	defer journal.mu.Unlock()
+	_, err := journal.file.WriteString(line)
+	return err
+}
+
+func (journal *importJournal) Close() error {
+	return journal.file.Close()
+}
+
+// removeImportJournal removes the journal once the import is complete
+func removeImportJournal(dataPath string) {
+	os.Remove(getImportJournalPath(dataPath))
+}
+
+// getImportDataPath returns the directory the import writes into: the source directory
+// for imports into a named source, the generation directory otherwise
+func getImportDataPath(generation, source string) string {
+	if source != "" {
+		return getSourcePath(source)
+	}
+	return getGenerationPath(generation)
+}
+
+// discardPendingImport drops the interrupted import superseded by a new one. The prefixes
+// already written into a source are kept, as the source is not served directly.
+func discardPendingImport(pending *PendingImport) {
+	if pending.Source != "" {
+		removeImportJournal(getSourcePath(pending.Source))
+		return
+	}
+	discardGeneration(pending.Generation)
+}
+
+// setPendingImport records (or clears, if pending is nil) the pending import in the state file
+func setPendingImport(pending *PendingImport) error {
+	state, err := readStateFile()
+	if err != nil {
+		return fmt.Errorf("failed to read state file: %v", err)
+	}
+	state.PendingImport = pending
+	return writeStateFile(state)
+}
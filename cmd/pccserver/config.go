@@ -0,0 +1,287 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+// The configuration file (--config or PCCSERVER_CONFIG) is a YAML document, e.g.
+//
+//	storage: /var/lib/pccserver
+//	server:
+//	  port: 8080
+//	  mode: [hash, psi]
+//	import:
+//	  url: https://api.pwnedpasswords.com/range/
+//	  concurrency: 32
+//	logging:
+//	  quiet: true
+//
+// Every key is bound to a command flag and an environment variable. The flags take precedence
+// over the environment variables, which take precedence over the configuration file.
+
+// configBinding binds a configuration key to the flag of the commands (the root flags if there are no commands)
+type configBinding struct {
+	key      string
+	env      string
+	flag     string
+	commands []string
+}
+
+var configBindings = []configBinding{
+	{key: "storage", env: "PCCSERVER_STORAGE", flag: "storage"},
+	{key: "metadata_store", env: "PCCSERVER_METADATA_STORE", flag: "metadata-store"},
+	{key: "logging.quiet", env: "PCCSERVER_QUIET", flag: "quiet"},
+	{key: "logging.file", env: "PCCSERVER_LOG_FILE", flag: "log-file"},
+	{key: "server.port", env: "PCCSERVER_PORT", flag: "port", commands: []string{"run-server"}},
+	{key: "server.mode", env: "PCCSERVER_MODE", flag: "mode", commands: []string{"run-server"}},
+	{key: "server.read_timeout", env: "PCCSERVER_READ_TIMEOUT", flag: "read-timeout", commands: []string{"run-server"}},
+	{key: "server.write_timeout", env: "PCCSERVER_WRITE_TIMEOUT", flag: "write-timeout", commands: []string{"run-server"}},
+	{key: "server.idle_timeout", env: "PCCSERVER_IDLE_TIMEOUT", flag: "idle-timeout", commands: []string{"run-server"}},
+	{key: "server.shutdown_timeout", env: "PCCSERVER_SHUTDOWN_TIMEOUT", flag: "shutdown-timeout", commands: []string{"run-server"}},
+	{key: "server.watch_state", env: "PCCSERVER_WATCH_STATE", flag: "watch-state", commands: []string{"run-server"}},
+	{key: "server.admin_address", env: "PCCSERVER_ADMIN_ADDRESS", flag: "admin-address", commands: []string{"run-server"}},
+	{key: "server.require_signed", env: "PCCSERVER_REQUIRE_SIGNED", flag: "require-signed", commands: []string{"run-server"}},
+	{key: "server.public_key", env: "PCCSERVER_PUBLIC_KEY", flag: "public-key", commands: []string{"run-server"}},
+	{key: "server.require_api_key", env: "PCCSERVER_REQUIRE_API_KEY", flag: "require-api-key", commands: []string{"run-server"}},
+	{key: "server.tls_cert", env: "PCCSERVER_TLS_CERT", flag: "tls-cert", commands: []string{"run-server"}},
+	{key: "server.tls_key", env: "PCCSERVER_TLS_KEY", flag: "tls-key", commands: []string{"run-server"}},
+	{key: "server.tls_client_ca", env: "PCCSERVER_TLS_CLIENT_CA", flag: "tls-client-ca", commands: []string{"run-server"}},
+	{key: "server.require_client_cert", env: "PCCSERVER_REQUIRE_CLIENT_CERT", flag: "require-client-cert", commands: []string{"run-server"}},
+	{key: "import.url", env: "PCCSERVER_IMPORT_URL", flag: "url", commands: []string{"import-values"}},
+	{key: "import.concurrency", env: "PCCSERVER_IMPORT_CONCURRENCY", flag: "concurrency", commands: []string{"import-values"}},
+	{key: "import.min_count", env: "PCCSERVER_MIN_COUNT", flag: "min-count", commands: []string{"import-values"}},
+	{key: "import.sign_key", env: "PCCSERVER_SIGN_KEY", flag: "sign-key", commands: []string{"import-values", "verify-storage"}},
+}
+
+var (
+	configFlag  string
+	storageFlag string
+	logFileFlag string
+)
+
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Inspect the configuration",
+}
+
+var configPrintCmd = &cobra.Command{
+	Use:   "print",
+	Short: "Print the effective configuration",
+	Long:  `Print the configuration merged from the defaults, the configuration file, the environment variables and the flags.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		values, err := readConfigFile()
+		if err != nil {
+			fmt.Printf("Error reading configuration: %v\n", err)
+			os.Exit(1)
+		}
+		effective, err := effectiveConfig(cmd, values)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		encoder := yaml.NewEncoder(os.Stdout)
+		encoder.SetIndent(2)
+		if err := encoder.Encode(effective); err != nil {
+			fmt.Printf("Error encoding configuration: %v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+func initConfigCmd() {
+	configCmd.AddCommand(configPrintCmd)
+}
+
+func getConfigPath() string {
+	if configFlag != "" {
+		return configFlag
+	}
+	return os.Getenv("PCCSERVER_CONFIG")
+}
+
+// readConfigFile returns the values of the configuration file by dotted key, none if there is no configuration file
+func readConfigFile() (map[string]string, error) {
+	values := map[string]string{}
+	path := getConfigPath()
+	if path == "" {
+		return values, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var document map[string]interface{}
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	if err := flattenConfig("", document, values); err != nil {
+		return nil, fmt.Errorf("invalid configuration in %s: %v", path, err)
+	}
+
+	for key := range values {
+		if findConfigBinding(key) == nil {
+			return nil, fmt.Errorf("unknown configuration key %q in %s", key, path)
+		}
+	}
+	return values, nil
+}
+
+// flattenConfig collects the values of the document by dotted key. Lists are joined with commas,
+// as the flags take comma-separated lists, and empty (null) values are skipped.
+func flattenConfig(prefix string, document map[string]interface{}, values map[string]string) error {
+	for key, value := range document {
+		switch value := value.(type) {
+		case nil:
+		case map[string]interface{}:
+			if err := flattenConfig(prefix+key+".", value, values); err != nil {
+				return err
+			}
+		case []interface{}:
+			items := make([]string, len(value))
+			for i, item := range value {
+				switch item.(type) {
+				case nil, map[string]interface{}, []interface{}:
+					return fmt.Errorf("%s: the list items must be scalar values", prefix+key)
+				}
+				items[i] = fmt.Sprint(item)
+			}
+			values[prefix+key] = strings.Join(items, ",")
+		default:
+			values[prefix+key] = fmt.Sprint(value)
+		}
+	}
+	return nil
+}
+
+func findConfigBinding(key string) *configBinding {
+	for i := range configBindings {
+		if configBindings[i].key == key {
+			return &configBindings[i]
+		}
+	}
+	return nil
+}
+
+// appliesTo reports whether the binding sets a flag of the command
+func (binding *configBinding) appliesTo(cmd *cobra.Command) bool {
+	if len(binding.commands) == 0 {
+		return true
+	}
+	for _, name := range binding.commands {
+		if cmd.Name() == name {
+			return true
+		}
+	}
+	return false
+}
+
+// configuredValue returns the value of the binding from the environment or the configuration file
+func (binding *configBinding) configuredValue(values map[string]string) (string, bool) {
+	if value, found := os.LookupEnv(binding.env); found {
+		return value, true
+	}
+	value, found := values[binding.key]
+	return value, found
+}
+
+// applyConfig sets the flags of the command which are not given on the command line
+// from the environment variables and the configuration file
+func applyConfig(cmd *cobra.Command) error {
+	values, err := readConfigFile()
+	if err != nil {
+		return fmt.Errorf("failed to read configuration: %v", err)
+	}
+	for i := range configBindings {
+		binding := &configBindings[i]
+		if !binding.appliesTo(cmd) {
+			continue
+		}
+		flag := cmd.Flags().Lookup(binding.flag)
+		if flag == nil || flag.Changed {
+			continue
+		}
+		if value, found := binding.configuredValue(values); found {
+			if err := flag.Value.Set(value); err != nil {
+				return fmt.Errorf("invalid %s value %q: %v", binding.key, value, err)
+			}
+		}
+	}
+
+	if err := validateMetadataStore(metadataStoreFlag); err != nil {
+		return err
+	}
+	if logFileFlag != "" {
+		file, err := os.OpenFile(logFileFlag, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return fmt.Errorf("failed to open log file: %v", err)
+		}
+		log.SetOutput(file)
+	}
+	return nil
+}
+
+// effectiveConfig returns the nested configuration the commands run with, the flags of the
+// current command take precedence over the environment and the configuration file
+func effectiveConfig(cmd *cobra.Command, values map[string]string) (map[string]interface{}, error) {
+	config := map[string]interface{}{}
+	for i := range configBindings {
+		binding := &configBindings[i]
+		var flag *pflag.Flag
+		if len(binding.commands) == 0 {
+			// The root flags are already resolved for the current command
+			flag = cmd.Flags().Lookup(binding.flag)
+		} else if command, _, err := rootCmd.Find([]string{binding.commands[0]}); err == nil {
+			flag = command.Flags().Lookup(binding.flag)
+		}
+		if flag == nil {
+			return nil, fmt.Errorf("configuration key %s is bound to an unknown flag", binding.key)
+		}
+
+		value := flag.Value.String()
+		if len(binding.commands) > 0 {
+			value = flag.DefValue
+			if configured, found := binding.configuredValue(values); found {
+				value = configured
+			}
+		}
+		if binding.key == "storage" && value == "" {
+			value = getStoragePath()
+		}
+		typed, err := typedConfigValue(flag.Value.Type(), value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s value %q: %v", binding.key, value, err)
+		}
+
+		section := config
+		path := strings.Split(binding.key, ".")
+		for _, name := range path[:len(path)-1] {
+			if _, found := section[name]; !found {
+				section[name] = map[string]interface{}{}
+			}
+			section = section[name].(map[string]interface{})
+		}
+		section[path[len(path)-1]] = typed
+	}
+	return config, nil
+}
+
+// typedConfigValue converts the flag value so that it is printed as a YAML number or boolean
+func typedConfigValue(flagType, value string) (interface{}, error) {
+	switch flagType {
+	case "bool":
+		return strconv.ParseBool(value)
+	case "int":
+		return strconv.Atoi(value)
+	case "uint64":
+		return strconv.ParseUint(value, 10, 64)
+	}
+	return value, nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Dataset describes the values of a hash function served by a generation
+type Dataset struct {
+	// Source is the URL or the file the values were imported from
+	Source     string    `json:"source"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	// Number of the non-empty prefixes
+	Prefixes int    `json:"prefixes"`
+	Records  uint64 `json:"records"`
+	// Sum of the counts of all records
+	CountSum uint64 `json:"count_sum"`
+	// Size of the prefix files and of the packed file
+	Bytes    int64  `json:"bytes"`
+	MinCount uint64 `json:"min_count,omitempty"`
+	// Version is incremented by every import of the hash function
+	Version uint64 `json:"version"`
+}
+
+// scanDataset fills the statistics of the dataset from the storage of the mode in the data directory
+// and writes the checksum manifest of the storage
+func scanDataset(dataset *Dataset, dataPath, mode string) error {
+	storage, err := openStorage(dataPath, mode)
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+
+	var prefixes, records, countSum atomic.Uint64
+	var checksumsMu sync.Mutex
+	checksums := map[string]string{}
+	err = processPrefixes(nil, func(prefix string) error {
+		data, err := readRawRange(storage, prefix)
+		if err != nil {
+			if err == errPrefixNotFound {
+				return nil
+			}
+			return err
+		}
+		checksumsMu.Lock()
+		checksums[prefix] = rangeChecksum(data)
+		checksumsMu.Unlock()
+
+		prefixRecords, err := parseRange(bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		if len(prefixRecords) > 0 {
+			prefixes.Add(1)
+		}
+		records.Add(uint64(len(prefixRecords)))
+		var sum uint64
+		for _, record := range prefixRecords {
+			sum += record.Count
+		}
+		countSum.Add(sum)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := writeManifest(dataPath, mode, checksums); err != nil {
+		return err
+	}
+
+	var size int64
+	if fileInfo, err := os.Stat(getPackedStoragePath(dataPath, mode)); err == nil {
+		size += fileInfo.Size()
+	}
+	err = filepath.WalkDir(filepath.Join(dataPath, getHashFunctionFolder(mode)), func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if entry.Type().IsRegular() {
+			fileInfo, err := entry.Info()
+			if err != nil {
+				return err
+			}
+			size += fileInfo.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to measure the storage size: %v", err)
+	}
+
+	dataset.Prefixes = int(prefixes.Load())
+	dataset.Records = records.Load()
+	dataset.CountSum = countSum.Load()
+	dataset.Bytes = size
+	return nil
+}
+
+// printDataset outputs the dataset of the hash function for output-state
+func printDataset(hashFunction string, dataset Dataset) {
+	fmt.Printf("Dataset %s (version %d):\n", hashFunction, dataset.Version)
+	fmt.Printf("  Source: %s\n", dataset.Source)
+	fmt.Printf("  Imported: %s - %s\n", dataset.StartedAt.Format(time.RFC3339), dataset.FinishedAt.Format(time.RFC3339))
+	fmt.Printf("  Prefixes: %d, records: %d, count sum: %d\n", dataset.Prefixes, dataset.Records, dataset.CountSum)
+	fmt.Printf("  Bytes on disk: %d\n", dataset.Bytes)
+	if dataset.MinCount > 0 {
+		fmt.Printf("  Minimum count: %d\n", dataset.MinCount)
+	}
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/petrkamnev/password-compromise-check-server/pkg/PasswordCompromiseCheckClientLib"
+	"github.com/spf13/cobra"
+)
+
+// Exclusions holds the full hashes which are never imported or served, by hash function.
+// The list is kept in exclusions.json next to state.json.
+type Exclusions map[string][]string
+
+var excludeCmd = &cobra.Command{
+	Use:   "exclude",
+	Short: "Manage the hashes excluded from the imports and responses",
+	Long:  `Manage the list of full hashes which are skipped by the importers and never returned by the server.`,
+}
+
+var excludeAddCmd = &cobra.Command{
+	Use:   "add HASH...",
+	Short: "Exclude the hashes",
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		lock, err := lockStorage(cmd)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		defer lock.unlock()
+		hashFunction, _ := cmd.Flags().GetString("hash-function")
+		if err := updateExclusions(hashFunction, args, true); err != nil {
+			fmt.Printf("Error updating exclusions: %v\n", err)
+		}
+	},
+}
+
+var excludeRemoveCmd = &cobra.Command{
+	Use:   "remove HASH...",
+	Short: "Remove the hashes from the exclusion list",
+	Long: `Remove the hashes from the exclusion list. The hashes skipped by the imports while they were excluded
+are not restored immediately: the next import of the hash function into the served storage downloads
+their prefixes again, ignoring the caching headers, and serves them.`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		lock, err := lockStorage(cmd)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		defer lock.unlock()
+		hashFunction, _ := cmd.Flags().GetString("hash-function")
+		if err := updateExclusions(hashFunction, args, false); err != nil {
+			fmt.Printf("Error updating exclusions: %v\n", err)
+		}
+	},
+}
+
+var excludeListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "Output the excluded hashes",
+	Run: func(cmd *cobra.Command, args []string) {
+		hashFunction, _ := cmd.Flags().GetString("hash-function")
+		exclusions, err := readExclusions()
+		if err != nil {
+			fmt.Printf("Error reading exclusions: %v\n", err)
+			return
+		}
+		modes := []string{}
+		for mode := range exclusions {
+			if hashFunction == "" || mode == hashFunction {
+				modes = append(modes, mode)
+			}
+		}
+		sort.Strings(modes)
+		for _, mode := range modes {
+			for _, hash := range exclusions[mode] {
+				fmt.Printf("%s %s\n", mode, hash)
+			}
+		}
+	},
+}
+
+func initExcludeCmd() {
+	excludeAddCmd.Flags().String("hash-function", PasswordCompromiseCheckClientLib.DefaultHashFunction, "Hash function of the hashes: "+hashFunctionsList())
+	excludeRemoveCmd.Flags().String("hash-function", PasswordCompromiseCheckClientLib.DefaultHashFunction, "Hash function of the hashes: "+hashFunctionsList())
+	excludeListCmd.Flags().String("hash-function", "", "Hash function to list the hashes of (by default all)")
+	excludeCmd.AddCommand(excludeAddCmd)
+	excludeCmd.AddCommand(excludeRemoveCmd)
+	excludeCmd.AddCommand(excludeListCmd)
+}
+
+func getExclusionsPath() string {
+	return filepath.Join(getStoragePath(), "exclusions.json")
+}
+
+func readExclusions() (Exclusions, error) {
+	file, err := os.Open(getExclusionsPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return Exclusions{}, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+	exclusions := Exclusions{}
+	if err := json.NewDecoder(file).Decode(&exclusions); err != nil {
+		return nil, fmt.Errorf("failed to decode exclusions file: %v", err)
+	}
+	return exclusions, nil
+}
+
+func writeExclusions(exclusions Exclusions) error {
+	if err := writeJSONFile(getExclusionsPath(), exclusions); err != nil {
+		return fmt.Errorf("failed to write exclusions file: %v", err)
+	}
+	return nil
+}
+
+// updateExclusions adds the hashes to the exclusion list of the hash function or removes them from it
+func updateExclusions(hashFunction string, hashes []string, add bool) error {
+	if err := validateHashFunction(hashFunction); err != nil {
+		return err
+	}
+	exclusions, err := readExclusions()
+	if err != nil {
+		return err
+	}
+
+	excluded := map[string]bool{}
+	for _, hash := range exclusions[hashFunction] {
+		excluded[hash] = true
+	}
+	restored := []string{}
+	for _, hash := range hashes {
+		hash = strings.ToUpper(hash)
+		if len(hash) != getDigestLength(hashFunction) || !isHexString(hash) {
+			return fmt.Errorf("%q is not a valid %s hash", hash, hashFunction)
+		}
+		if add {
+			excluded[hash] = true
+		} else if excluded[hash] {
+			delete(excluded, hash)
+			restored = append(restored, hash[:5])
+		}
+	}
+
+	list := make([]string, 0, len(excluded))
+	for hash := range excluded {
+		list = append(list, hash)
+	}
+	sort.Strings(list)
+	if len(list) == 0 {
+		delete(exclusions, hashFunction)
+	} else {
+		exclusions[hashFunction] = list
+	}
+	if err := writeExclusions(exclusions); err != nil {
+		return err
+	}
+	if len(restored) == 0 {
+		return nil
+	}
+	return updateRestoredPrefixes(hashFunction, restored)
+}
+
+// updateRestoredPrefixes records the prefixes of the hashes removed from the exclusion list of the hash function,
+// so the next import downloads them again instead of keeping the ranges filtered while the hashes were excluded.
+// No prefixes clear the recorded ones.
+func updateRestoredPrefixes(hashFunction string, prefixes []string) error {
+	state, err := readStateFile()
+	if err != nil {
+		return fmt.Errorf("failed to read state file: %v", err)
+	}
+	if len(prefixes) == 0 {
+		if len(state.RestoredPrefixes[hashFunction]) == 0 {
+			return nil
+		}
+		delete(state.RestoredPrefixes, hashFunction)
+	} else {
+		if state.RestoredPrefixes == nil {
+			state.RestoredPrefixes = map[string][]string{}
+		}
+		restored := map[string]bool{}
+		for _, prefix := range append(state.RestoredPrefixes[hashFunction], prefixes...) {
+			restored[prefix] = true
+		}
+		list := make([]string, 0, len(restored))
+		for prefix := range restored {
+			list = append(list, prefix)
+		}
+		sort.Strings(list)
+		state.RestoredPrefixes[hashFunction] = list
+	}
+	return writeStateFile(state)
+}
+
+// excludingStorage hides the excluded suffixes of the underlying storage and skips them when writing
+type excludingStorage struct {
+	Storage
+	// Excluded suffixes by prefix
+	excluded map[string]map[string]bool
+	// Digests of the excluded suffixes by prefix and the modification time of the exclusion list, mixed into
+	// the caching metadata of the served ranges. Nil for the storages of the importers, whose metadata
+	// is validated by the upstream.
+	digests map[string]string
+	modTime time.Time
+}
+
+// withExclusions wraps the storage of the mode so the excluded hashes are neither read nor written
+func withExclusions(storage Storage, exclusions Exclusions, mode string) Storage {
+	if len(exclusions[mode]) == 0 {
+		return storage
+	}
+	excluded := map[string]map[string]bool{}
+	for _, hash := range exclusions[mode] {
+		prefix, suffix := hash[:5], hash[5:]
+		if excluded[prefix] == nil {
+			excluded[prefix] = map[string]bool{}
+		}
+		excluded[prefix][suffix] = true
+	}
+	return &excludingStorage{Storage: storage, excluded: excluded}
+}
+
+// withServedExclusions wraps the served storage of the mode, so the excluded hashes are not returned
+// and the ranges cached by the clients before the exclusion are not validated
+func withServedExclusions(storage Storage, exclusions Exclusions, mode string) Storage {
+	wrapped, ok := withExclusions(storage, exclusions, mode).(*excludingStorage)
+	if !ok {
+		return storage
+	}
+	wrapped.digests = map[string]string{}
+	for prefix, excluded := range wrapped.excluded {
+		suffixes := make([]string, 0, len(excluded))
+		for suffix := range excluded {
+			suffixes = append(suffixes, suffix)
+		}
+		sort.Strings(suffixes)
+		digest := sha256.Sum256([]byte(strings.Join(suffixes, "\n")))
+		wrapped.digests[prefix] = hex.EncodeToString(digest[:8])
+	}
+	if fileInfo, err := os.Stat(getExclusionsPath()); err == nil {
+		wrapped.modTime = fileInfo.ModTime()
+	}
+	return wrapped
+}
+
+// openServedStorage opens the currently served storage of the mode without the excluded hashes
+func openServedStorage(mode string) (Storage, error) {
+	exclusions, err := readExclusions()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read exclusions: %v", err)
+	}
+	storage, err := openStorage(getDataPath(), mode)
+	if err != nil {
+		return nil, err
+	}
+	return withServedExclusions(storage, exclusions, mode), nil
+}
+
+func (storage *excludingStorage) filter(prefix string, records []HashRecord) []HashRecord {
+	excluded := storage.excluded[prefix]
+	if excluded == nil {
+		return records
+	}
+	filtered := make([]HashRecord, 0, len(records))
+	for _, record := range records {
+		if !excluded[record.Suffix] {
+			filtered = append(filtered, record)
+		}
+	}
+	return filtered
+}
+
+func (storage *excludingStorage) GetRange(prefix string) ([]HashRecord, error) {
+	records, err := storage.Storage.GetRange(prefix)
+	if err != nil {
+		return nil, err
+	}
+	return storage.filter(prefix, records), nil
+}
+
+func (storage *excludingStorage) LookupSuffix(prefix, suffix string) (uint64, error) {
+	if storage.excluded[prefix][suffix] {
+		return 0, nil
+	}
+	return storage.Storage.LookupSuffix(prefix, suffix)
+}
+
+func (storage *excludingStorage) PutRange(prefix string, records []HashRecord, metadata PrefixMetadata) error {
+	return storage.Storage.PutRange(prefix, storage.filter(prefix, records), metadata)
+}
+
+// Metadata of a served prefix with exclusions changes with its excluded suffixes and the exclusion list
+func (storage *excludingStorage) Metadata(prefix string) (PrefixMetadata, error) {
+	metadata, err := storage.Storage.Metadata(prefix)
+	digest, found := storage.digests[prefix]
+	if err != nil || !found {
+		return metadata, err
+	}
+	if metadata.ETag != "" {
+		metadata.ETag = fmt.Sprintf("\"%s-%s\"", strings.Trim(metadata.ETag, "\""), digest)
+	}
+	if storage.modTime.After(metadata.LastModified) {
+		metadata.LastModified = storage.modTime
+	}
+	return metadata, nil
+}
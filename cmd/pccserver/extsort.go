@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"container/heap"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// hashRecordReader iterates over "HASH:COUNT" records, returning io.EOF after the last one
+type hashRecordReader interface {
+	Next() (string, uint64, error)
+}
+
+// lineRecordReader reads the records of a HIBP dump, one "HASH:COUNT" record per line
+type lineRecordReader struct {
+	scanner    *bufio.Scanner
+	hashLength int
+	line       int
+}
+
+func newLineRecordReader(reader io.Reader, suffixLength int) *lineRecordReader {
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	return &lineRecordReader{scanner: scanner, hashLength: 5 + suffixLength}
+}
+
+func (reader *lineRecordReader) Next() (string, uint64, error) {
+	for reader.scanner.Scan() {
+		reader.line++
+		line := strings.TrimSpace(reader.scanner.Text())
+		if line == "" {
+			continue
+		}
+		hash, countValue, found := strings.Cut(line, ":")
+		if !found || len(hash) != reader.hashLength || !isHexString(hash) {
+			return "", 0, fmt.Errorf("invalid record on line %d: %q", reader.line, line)
+		}
+		count, err := strconv.ParseUint(countValue, 10, 64)
+		if err != nil {
+			return "", 0, fmt.Errorf("invalid count on line %d: %q", reader.line, line)
+		}
+		return strings.ToUpper(hash), count, nil
+	}
+	if err := reader.scanner.Err(); err != nil {
+		return "", 0, err
+	}
+	return "", 0, io.EOF
+}
+
+type sortedRecord struct {
+	hash  string
+	count uint64
+}
+
+// sortRecords sorts the records by hash with bounded memory: sorted runs of at most
+// maxRecords records are written to temporary files and merged while reading
+func sortRecords(reader hashRecordReader, maxRecords int, tempDir string) (*mergedRecordReader, error) {
+	merged := &mergedRecordReader{}
+	buffer := make([]sortedRecord, 0, min(maxRecords, 1<<20))
+	flush := func() error {
+		if len(buffer) == 0 {
+			return nil
+		}
+		sort.Slice(buffer, func(i, j int) bool { return buffer[i].hash < buffer[j].hash })
+		run, err := os.CreateTemp(tempDir, "pccserver-sort-*")
+		if err != nil {
+			return err
+		}
+		os.Remove(run.Name()) // The run is removed as soon as it is closed
+		writer := bufio.NewWriterSize(run, 1<<20)
+		for _, record := range buffer {
+			fmt.Fprintf(writer, "%s:%d\n", record.hash, record.count)
+		}
+		if err := writer.Flush(); err != nil {
+			run.Close()
+			return err
+		}
+		if _, err := run.Seek(0, io.SeekStart); err != nil {
+			run.Close()
+			return err
+		}
+		merged.runs = append(merged.runs, run)
+		buffer = buffer[:0]
+		return nil
+	}
+
+	hashLength := 0
+	for {
+		hash, count, err := reader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			merged.Close()
+			return nil, err
+		}
+		hashLength = len(hash)
+		buffer = append(buffer, sortedRecord{hash: hash, count: count})
+		if len(buffer) >= maxRecords {
+			if err := flush(); err != nil {
+				merged.Close()
+				return nil, err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		merged.Close()
+		return nil, err
+	}
+
+	for _, run := range merged.runs {
+		runReader := newLineRecordReader(bufio.NewReaderSize(run, 1<<20), hashLength-5)
+		hash, count, err := runReader.Next()
+		if err == io.EOF {
+			continue
+		} else if err != nil {
+			merged.Close()
+			return nil, err
+		}
+		merged.heap = append(merged.heap, &runHead{reader: runReader, hash: hash, count: count})
+	}
+	heap.Init(&merged.heap)
+	return merged, nil
+}
+
+// mergedRecordReader merges the sorted runs
+type mergedRecordReader struct {
+	runs []*os.File
+	heap runHeap
+}
+
+func (merged *mergedRecordReader) Next() (string, uint64, error) {
+	if len(merged.heap) == 0 {
+		return "", 0, io.EOF
+	}
+	head := merged.heap[0]
+	hash, count := head.hash, head.count
+	nextHash, nextCount, err := head.reader.Next()
+	if err == io.EOF {
+		heap.Pop(&merged.heap)
+	} else if err != nil {
+		return "", 0, err
+	} else {
+		head.hash, head.count = nextHash, nextCount
+		heap.Fix(&merged.heap, 0)
+	}
+	return hash, count, nil
+}
+
+func (merged *mergedRecordReader) Close() error {
+	for _, run := range merged.runs {
+		run.Close()
+	}
+	return nil
+}
+
+type runHead struct {
+	reader *lineRecordReader
+	hash   string
+	count  uint64
+}
+
+type runHeap []*runHead
+
+func (h runHeap) Len() int           { return len(h) }
+func (h runHeap) Less(i, j int) bool { return h[i].hash < h[j].hash }
+func (h runHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *runHeap) Push(x any)        { *h = append(*h, x.(*runHead)) }
+func (h *runHeap) Pop() any {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
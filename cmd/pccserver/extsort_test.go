@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// sliceRecordReader returns the records of a slice
+type sliceRecordReader struct {
+	records []sortedRecord
+}
+
+func (reader *sliceRecordReader) Next() (string, uint64, error) {
+	if len(reader.records) == 0 {
+		return "", 0, io.EOF
+	}
+	record := reader.records[0]
+	reader.records = reader.records[1:]
+	return record.hash, record.count, nil
+}
+
+func TestSortRecords(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	records := make([]sortedRecord, 1000)
+	for i := range records {
+		// Few distinct prefixes, so the runs interleave
+		records[i] = sortedRecord{hash: fmt.Sprintf("%05X%035X", random.Intn(16), random.Int63()), count: uint64(i)}
+	}
+	// A duplicate hash is kept
+	records = append(records, records[0])
+
+	tests := []struct {
+		name       string
+		records    []sortedRecord
+		maxRecords int
+		runs       int
+	}{
+		{"empty", nil, 10, 0},
+		{"single run", records, 2000, 1},
+		{"exact runs", records, 77, 13},
+		{"one record per run", records[:50], 1, 50},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reader := &sliceRecordReader{records: append([]sortedRecord{}, test.records...)}
+			merged, err := sortRecords(reader, test.maxRecords, t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer merged.Close()
+			if len(merged.runs) != test.runs {
+				t.Errorf("sorted into %d runs, want %d", len(merged.runs), test.runs)
+			}
+
+			got := []sortedRecord{}
+			for {
+				hash, count, err := merged.Next()
+				if err == io.EOF {
+					break
+				} else if err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, sortedRecord{hash: hash, count: count})
+			}
+			if !sort.SliceIsSorted(got, func(i, j int) bool { return got[i].hash < got[j].hash }) {
+				t.Error("the records are not sorted by hash")
+			}
+			// Records with equal hashes may be merged in any order
+			want := append([]sortedRecord{}, test.records...)
+			byHashAndCount := func(records []sortedRecord) func(i, j int) bool {
+				return func(i, j int) bool {
+					return records[i].hash < records[j].hash || records[i].hash == records[j].hash && records[i].count < records[j].count
+				}
+			}
+			sort.Slice(got, byHashAndCount(got))
+			sort.Slice(want, byHashAndCount(want))
+			if len(got) != len(want) || len(want) > 0 && !reflect.DeepEqual(got, want) {
+				t.Errorf("sortRecords returned %d records not matching the %d input records", len(got), len(want))
+			}
+		})
+	}
+}
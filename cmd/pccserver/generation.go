@@ -0,0 +1,288 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/petrkamnev/password-compromise-check-server/pkg/PasswordCompromiseCheckClientLib"
+	"github.com/spf13/cobra"
+)
+
+// Every import writes into a new generation directory (<storage>/generations/<id>), which starts as
+// a hard-linked copy of the current one. When the import succeeds the <storage>/current symlink is
+// atomically switched to the new generation. Storages created before generations were introduced
+// keep their data in the storage root, which is served until the first generation is activated.
+const (
+	generationsDirectory  = "generations"
+	currentGenerationLink = "current"
+	generationIDLayout    = "20060102T150405.000000000Z"
+	// Number of generations kept for rollbacks
+	keptGenerationsCount = 3
+)
+
+// Generation describes a storage generation recorded in the state file
+type Generation struct {
+	ID            string             `json:"id"`
+	CreatedAt     time.Time          `json:"created_at"`
+	HashFunctions []string           `json:"hash_functions"`
+	Datasets      map[string]Dataset `json:"datasets,omitempty"`
+}
+
+var rollbackCmd = &cobra.Command{
+	Use:   "rollback",
+	Short: "Switch the storage back to the previous generation",
+	Long:  `Switch the served storage back to the previous (or a given) generation of the imported values.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		lock, err := lockStorage(cmd)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		defer lock.unlock()
+		generation, _ := cmd.Flags().GetString("generation")
+		if err := rollbackGeneration(generation); err != nil {
+			fmt.Printf("Error rolling back: %v\n", err)
+			return
+		}
+		if !quietFlag {
+			state, err := readStateFile()
+			if err == nil {
+				fmt.Printf("Current generation: %s\n", state.CurrentGeneration)
+			}
+		}
+	},
+}
+
+func initRollbackCmd() {
+	rollbackCmd.Flags().String("generation", "", "Generation to switch to (by default the one preceding the current generation)")
+}
+
+// getDataPath returns the directory holding the currently served data
+func getDataPath() string {
+	currentPath := filepath.Join(getStoragePath(), currentGenerationLink)
+	if _, err := os.Stat(currentPath); err == nil {
+		return currentPath
+	}
+	return getStoragePath()
+}
+
+func getGenerationPath(id string) string {
+	return filepath.Join(getStoragePath(), generationsDirectory, id)
+}
+
+// createGeneration creates a new generation directory holding hard links to the current data
+func createGeneration() (string, error) {
+	id, err := createEmptyGeneration()
+	if err != nil {
+		return "", err
+	}
+	generationPath := getGenerationPath(id)
+	if err := cloneData(getDataPath(), generationPath); err != nil {
+		os.RemoveAll(generationPath)
+		return "", fmt.Errorf("failed to copy the current data: %v", err)
+	}
+	return id, nil
+}
+
+// createEmptyGeneration creates a new generation directory without any data
+func createEmptyGeneration() (string, error) {
+	id := time.Now().UTC().Format(generationIDLayout)
+	if err := os.MkdirAll(getGenerationPath(id), 0755); err != nil {
+		return "", fmt.Errorf("failed to create generation directory: %v", err)
+	}
+	return id, nil
+}
+
+// cloneData hard-links the prefix files, packed files, manifests, their signatures and the metadata indexes of all hash functions
+func cloneData(sourcePath, targetPath string) error {
+	for _, mode := range PasswordCompromiseCheckClientLib.HashFunctionNames() {
+		for _, path := range []string{getPackedStoragePath(sourcePath, mode), getManifestPath(sourcePath, mode), getManifestSignaturePath(sourcePath, mode), getSidecarMetadataPath(sourcePath, mode)} {
+			if _, err := os.Stat(path); err == nil {
+				if err := os.Link(path, filepath.Join(targetPath, filepath.Base(path))); err != nil {
+					return err
+				}
+			}
+		}
+
+		folder := getHashFunctionFolder(mode)
+		entries, err := os.ReadDir(filepath.Join(sourcePath, folder))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Join(targetPath, folder), 0755); err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if !entry.Type().IsRegular() {
+				continue
+			}
+			err := os.Link(filepath.Join(sourcePath, folder, entry.Name()), filepath.Join(targetPath, folder, entry.Name()))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// discardGeneration removes a generation which has not been activated
+func discardGeneration(id string) {
+	if err := os.RemoveAll(getGenerationPath(id)); err != nil {
+		fmt.Printf("Error removing generation %s: %v\n", id, err)
+	}
+}
+
+// activateGeneration switches the current symlink to the generation and records it in the state file.
+// The generation supports the hash functions of the current generation and the ones of the given datasets,
+// which replace the datasets of the current generation. If a signing key is given, the manifests of all hash
+// functions of the generation are signed before it is activated.
+func activateGeneration(id string, datasets map[string]Dataset, signingKey ed25519.PrivateKey) error {
+	hashFunctions := make([]string, 0, len(datasets))
+	for hashFunction := range datasets {
+		hashFunctions = append(hashFunctions, hashFunction)
+	}
+	sort.Strings(hashFunctions)
+	for _, hashFunction := range hashFunctions {
+		if !quietFlag {
+			fmt.Printf("Collecting %s dataset statistics...\n", hashFunction)
+		}
+		dataset := datasets[hashFunction]
+		if err := scanDataset(&dataset, getGenerationPath(id), hashFunction); err != nil {
+			return fmt.Errorf("failed to collect %s dataset statistics: %v", hashFunction, err)
+		}
+		datasets[hashFunction] = dataset
+	}
+
+	state, err := readStateFile()
+	if err != nil {
+		return fmt.Errorf("failed to read state file: %v", err)
+	}
+
+	generation := Generation{
+		ID:            id,
+		CreatedAt:     time.Now().UTC(),
+		HashFunctions: append([]string{}, state.SupportedHashFunctions...),
+		Datasets:      map[string]Dataset{},
+	}
+	for hashFunction, dataset := range state.Datasets {
+		generation.Datasets[hashFunction] = dataset
+	}
+	for _, hashFunction := range hashFunctions {
+		dataset := datasets[hashFunction]
+		if dataset.FinishedAt.IsZero() {
+			dataset.FinishedAt = time.Now().UTC()
+		}
+		// Repacking keeps the version of the values
+		if dataset.Version == 0 {
+			dataset.Version = state.Datasets[hashFunction].Version + 1
+		}
+		generation.Datasets[hashFunction] = dataset
+
+		found := false
+		for _, funcName := range generation.HashFunctions {
+			if funcName == hashFunction {
+				found = true
+				break
+			}
+		}
+		if !found {
+			generation.HashFunctions = append(generation.HashFunctions, hashFunction)
+		}
+	}
+	if signingKey != nil {
+		if err := signManifests(getGenerationPath(id), generation.HashFunctions, signingKey); err != nil {
+			return fmt.Errorf("failed to sign manifests: %v", err)
+		}
+	}
+	state.Generations = append(state.Generations, generation)
+	if state.PendingImport != nil && state.PendingImport.Generation == id {
+		state.PendingImport = nil
+	}
+
+	return switchGeneration(state, generation)
+}
+
+// rollbackGeneration switches to the given generation or to the one preceding the current generation
+func rollbackGeneration(id string) error {
+	state, err := readStateFile()
+	if err != nil {
+		return fmt.Errorf("failed to read state file: %v", err)
+	}
+
+	var target *Generation
+	for i := range state.Generations {
+		generation := &state.Generations[i]
+		if id != "" {
+			if generation.ID == id {
+				target = generation
+			}
+			continue
+		}
+		if generation.ID == state.CurrentGeneration {
+			break
+		}
+		target = generation
+	}
+	if target == nil {
+		if id != "" {
+			return fmt.Errorf("unknown generation: %s", id)
+		}
+		return fmt.Errorf("there is no generation preceding the current one")
+	}
+	if _, err := os.Stat(getGenerationPath(target.ID)); err != nil {
+		return fmt.Errorf("generation %s is not available: %v", target.ID, err)
+	}
+	return switchGeneration(state, *target)
+}
+
+// switchGeneration atomically replaces the current symlink and updates the state file
+func switchGeneration(state *State, generation Generation) error {
+	// The sidecar indexes are appended to while importing, they are on the disk before the generation is served
+	if err := syncSidecarMetadataStores(getGenerationPath(generation.ID)); err != nil {
+		return err
+	}
+	linkPath := filepath.Join(getStoragePath(), currentGenerationLink)
+	tmpLinkPath := linkPath + ".tmp"
+	os.Remove(tmpLinkPath)
+	if err := os.Symlink(filepath.Join(generationsDirectory, generation.ID), tmpLinkPath); err != nil {
+		return fmt.Errorf("failed to create current generation link: %v", err)
+	}
+	if err := os.Rename(tmpLinkPath, linkPath); err != nil {
+		os.Remove(tmpLinkPath)
+		return fmt.Errorf("failed to switch current generation link: %v", err)
+	}
+
+	state.CurrentGeneration = generation.ID
+	state.SupportedHashFunctions = generation.HashFunctions
+	state.Datasets = generation.Datasets
+	pruneGenerations(state)
+	return writeStateFile(state)
+}
+
+// pruneGenerations removes the oldest generations, keeping the current one and the ones
+// still served by running servers (e.g. with "watch-state" disabled or after a failed reload)
+func pruneGenerations(state *State) {
+	sort.SliceStable(state.Generations, func(i, j int) bool {
+		return state.Generations[i].CreatedAt.Before(state.Generations[j].CreatedAt)
+	})
+	servedIDs := servedGenerations()
+	kept := []Generation{}
+	for i, generation := range state.Generations {
+		expired := len(state.Generations)-i > keptGenerationsCount
+		if expired && generation.ID != state.CurrentGeneration && !servedIDs[generation.ID] {
+			err := os.RemoveAll(getGenerationPath(generation.ID))
+			if err == nil {
+				continue
+			}
+			fmt.Printf("Error removing generation %s: %v\n", generation.ID, err)
+		}
+		kept = append(kept, generation)
+	}
+	state.Generations = kept
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/petrkamnev/password-compromise-check-server/pkg/PasswordCompromiseCheckClientLib"
+)
+
+// The hash functions are described by the registry of the client library. The server refers to
+// them by name ("mode"), the storage of a hash function is kept in its registered folder.
+
+// hashFunctionsList lists the quoted names of the registered hash functions for flag descriptions and errors
+func hashFunctionsList() string {
+	names := PasswordCompromiseCheckClientLib.HashFunctionNames()
+	for i, name := range names {
+		names[i] = "\"" + name + "\""
+	}
+	return strings.Join(names, ", ")
+}
+
+// validateHashFunction checks the value of a "hash-function" parameter
+func validateHashFunction(name string) error {
+	if _, ok := PasswordCompromiseCheckClientLib.LookupHashFunction(name); !ok {
+		return fmt.Errorf("incorrect \"hash-function\" parameter value. Allowed values: %s", hashFunctionsList())
+	}
+	return nil
+}
+
+// getRequestMode returns the hash function of the "mode" query parameter, the default one if it is absent or unknown
+func getRequestMode(r *http.Request) string {
+	mode := r.URL.Query().Get("mode")
+	if _, ok := PasswordCompromiseCheckClientLib.LookupHashFunction(mode); !ok {
+		return PasswordCompromiseCheckClientLib.DefaultHashFunction
+	}
+	return mode
+}
+
+// getSuffixLength returns the length (in hex chars) of the hash suffixes of the mode
+func getSuffixLength(mode string) int {
+	hashFunction, ok := PasswordCompromiseCheckClientLib.LookupHashFunction(mode)
+	if !ok {
+		return 0
+	}
+	return hashFunction.SuffixLength()
+}
+
+// getDigestLength returns the length (in hex chars) of the hashes of the mode
+func getDigestLength(mode string) int {
+	hashFunction, _ := PasswordCompromiseCheckClientLib.LookupHashFunction(mode)
+	return hashFunction.DigestLength
+}
+
+// getHashFunctionFolder returns the name of the storage directory of the mode
+func getHashFunctionFolder(mode string) string {
+	if hashFunction, ok := PasswordCompromiseCheckClientLib.LookupHashFunction(mode); ok {
+		return hashFunction.Folder
+	}
+	return mode
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// importInput is the decompressed stream of the import file
+type importInput struct {
+	io.Reader
+	closers []func() error
+}
+
+func (input *importInput) Close() error {
+	var err error
+	for i := len(input.closers) - 1; i >= 0; i-- {
+		if closeErr := input.closers[i](); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// openImportInput opens the import file ("-" for the standard input). Gzip and zstd inputs are
+// decompressed transparently, the format is detected by the file extension or the magic bytes.
+func openImportInput(filename string) (*importInput, error) {
+	input := &importInput{}
+	var file *os.File
+	if filename == "-" {
+		file = os.Stdin
+	} else {
+		var err error
+		file, err = os.Open(filename)
+		if err != nil {
+			return nil, err
+		}
+		input.closers = append(input.closers, file.Close)
+	}
+	reader := bufio.NewReaderSize(file, 1<<20)
+	// Peek fails on inputs shorter than the magic, which are plain text then
+	magic, _ := reader.Peek(len(zstdMagic))
+
+	extension := strings.ToLower(strings.TrimPrefix(filepath.Ext(filename), "."))
+	switch {
+	case extension == "gz" || extension == "gzip" || bytes.HasPrefix(magic, gzipMagic):
+		decompressor, err := gzip.NewReader(reader)
+		if err != nil {
+			input.Close()
+			return nil, err
+		}
+		input.Reader = decompressor
+		input.closers = append(input.closers, decompressor.Close)
+	case extension == "zst" || extension == "zstd" || bytes.HasPrefix(magic, zstdMagic):
+		decompressor, err := zstd.NewReader(reader)
+		if err != nil {
+			input.Close()
+			return nil, err
+		}
+		input.Reader = decompressor
+		input.closers = append(input.closers, func() error {
+			decompressor.Close()
+			return nil
+		})
+	default:
+		input.Reader = reader
+	}
+	return input, nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// The commands writing the storage or the state file hold an exclusive flock of <storage>/storage.lock
+// while they run. The holder of the lock records itself in the lock file, so the other commands can
+// report it. The lock is released by the kernel when the holding process exits.
+const storageLockFile = "storage.lock"
+
+// lockHolder describes the process holding the storage lock
+type lockHolder struct {
+	PID       int       `json:"pid"`
+	Command   string    `json:"command"`
+	Host      string    `json:"host"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+type storageLock struct {
+	file *os.File
+}
+
+// lockStorage takes the storage lock for the command, failing if another process holds it
+func lockStorage(cmd *cobra.Command) (*storageLock, error) {
+	if err := os.MkdirAll(getStoragePath(), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create storage directory: %v", err)
+	}
+	path := filepath.Join(getStoragePath(), storageLockFile)
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open storage lock: %v", err)
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, fmt.Errorf("the storage is locked by %s", describeLockHolder(path))
+		}
+		return nil, fmt.Errorf("failed to lock storage: %v", err)
+	}
+
+	host, _ := os.Hostname()
+	holder := lockHolder{
+		PID:       os.Getpid(),
+		Command:   strings.TrimSpace(cmd.CommandPath()),
+		Host:      host,
+		StartedAt: time.Now().UTC(),
+	}
+	data, err := json.Marshal(holder)
+	if err == nil {
+		err = file.Truncate(0)
+	}
+	if err == nil {
+		_, err = file.WriteAt(append(data, '\n'), 0)
+	}
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to record storage lock holder: %v", err)
+	}
+	return &storageLock{file: file}, nil
+}
+
+func (lock *storageLock) unlock() {
+	// The holder record is kept, it is only reported while the lock is held
+	lock.file.Close()
+}
+
+// describeLockHolder returns the holder recorded in the lock file
+func describeLockHolder(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "another process"
+	}
+	var holder lockHolder
+	if err := json.Unmarshal(data, &holder); err != nil || holder.PID == 0 {
+		return "another process"
+	}
+	return fmt.Sprintf("process %d on %s (%q, started %s)", holder.PID, holder.Host, holder.Command, holder.StartedAt.Format(time.RFC3339))
+}
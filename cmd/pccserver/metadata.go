@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/xattr"
+)
+
+// The caching metadata of the prefix files is kept in the "user.etag" extended attribute and the
+// modification time of the files. Some filesystems (overlayfs, NFS, some tmpfs and Docker volume
+// drivers) do not support extended attributes, so the metadata can be kept in a sidecar index
+// instead (<data>/<folder>.meta), a "PREFIX\tETAG\tLAST-MODIFIED" line per prefix. A later line of a prefix
+// supersedes the earlier ones.
+const (
+	metadataStoreAuto    = "auto"
+	metadataStoreXattr   = "xattr"
+	metadataStoreSidecar = "sidecar"
+)
+
+var metadataStoreFlag string
+
+// validateMetadataStore checks the value of the "metadata-store" parameter
+func validateMetadataStore(value string) error {
+	switch value {
+	case metadataStoreAuto, metadataStoreXattr, metadataStoreSidecar:
+		return nil
+	}
+	return fmt.Errorf("incorrect \"metadata-store\" parameter value. Allowed values: \"auto\", \"xattr\", \"sidecar\"")
+}
+
+func getSidecarMetadataPath(dataPath, mode string) string {
+	return filepath.Join(dataPath, getHashFunctionFolder(mode)+".meta")
+}
+
+// getSidecarMetadataStore returns the sidecar store of the mode in the data directory, or nil if the metadata
+// is kept in extended attributes. In the auto mode the sidecar is used once it exists, or for writing if the
+// filesystem of the data directory does not support extended attributes. The readers do not probe the
+// filesystem, as the served data directory may be read-only.
+func getSidecarMetadataStore(dataPath, mode string, writable bool) *sidecarMetadataStore {
+	path := getSidecarMetadataPath(dataPath, mode)
+	switch metadataStoreFlag {
+	case metadataStoreXattr:
+		return nil
+	case metadataStoreSidecar:
+		return openSidecarMetadataStore(path)
+	}
+	if _, err := os.Stat(path); err == nil || writable && !xattrsSupported(dataPath) {
+		return openSidecarMetadataStore(path)
+	}
+	return nil
+}
+
+var (
+	xattrSupportMu sync.Mutex
+	xattrSupport   = map[string]bool{}
+)
+
+// xattrsSupported probes once per directory whether user extended attributes can be set
+func xattrsSupported(directory string) bool {
+	xattrSupportMu.Lock()
+	defer xattrSupportMu.Unlock()
+	if supported, found := xattrSupport[directory]; found {
+		return supported
+	}
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return false
+	}
+	file, err := os.CreateTemp(directory, ".xattr-probe-*")
+	if err != nil {
+		return false
+	}
+	file.Close()
+	defer os.Remove(file.Name())
+	supported := xattr.Set(file.Name(), "user.etag", []byte("probe")) == nil
+	if !supported && !quietFlag {
+		fmt.Printf("Extended attributes are not supported in %s, the caching metadata is kept in sidecar files\n", directory)
+	}
+	xattrSupport[directory] = supported
+	return supported
+}
+
+// sidecarEntry is the metadata of a prefix kept in the sidecar index
+type sidecarEntry struct {
+	ETag         string
+	LastModified time.Time
+}
+
+// sidecarMetadataStore is the sidecar index of a hash function. The stores are shared by the storages
+// of the process, readers reload the index when the file changes. The first write replaces the index
+// with a compacted copy, as it may be hard-linked from other generations, and then appends to it.
+type sidecarMetadataStore struct {
+	path    string
+	mu      sync.Mutex
+	entries map[string]sidecarEntry
+	// Size and modification time of the loaded index
+	size    int64
+	modTime time.Time
+	// Append handle of the writing process
+	file *os.File
+	// Whether the writing process has replaced the index with its own copy
+	compacted bool
+}
+
+var (
+	sidecarStoresMu sync.Mutex
+	sidecarStores   = map[string]*sidecarMetadataStore{}
+)
+
+func openSidecarMetadataStore(path string) *sidecarMetadataStore {
+	sidecarStoresMu.Lock()
+	defer sidecarStoresMu.Unlock()
+	store, found := sidecarStores[path]
+	if !found {
+		store = &sidecarMetadataStore{path: path}
+		sidecarStores[path] = store
+	}
+	return store
+}
+
+// load reads the index unless it is loaded and unchanged. The caller holds the lock.
+func (store *sidecarMetadataStore) load() error {
+	if store.file != nil {
+		return nil
+	}
+	fileInfo, err := os.Stat(store.path)
+	if os.IsNotExist(err) {
+		if store.entries == nil {
+			store.entries = map[string]sidecarEntry{}
+		}
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if store.entries != nil && fileInfo.Size() == store.size && fileInfo.ModTime().Equal(store.modTime) {
+		return nil
+	}
+
+	file, err := os.Open(store.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	entries := map[string]sidecarEntry{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// The indexes written by the earlier versions have the record count and the checksum in two more fields
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) != 3 && len(fields) != 5 {
+			// A line cut by an interrupted write
+			continue
+		}
+		lastModified, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			continue
+		}
+		entries[fields[0]] = sidecarEntry{
+			ETag:         fields[1],
+			LastModified: time.Unix(0, lastModified),
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read metadata index: %v", err)
+	}
+	store.entries = entries
+	store.size = fileInfo.Size()
+	store.modTime = fileInfo.ModTime()
+	return nil
+}
+
+func (store *sidecarMetadataStore) get(prefix string) (sidecarEntry, bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if err := store.load(); err != nil {
+		return sidecarEntry{}, false, err
+	}
+	entry, found := store.entries[prefix]
+	return entry, found, nil
+}
+
+func (store *sidecarMetadataStore) put(prefix string, entry sidecarEntry) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.file == nil && store.compacted {
+		file, err := os.OpenFile(store.path, os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return fmt.Errorf("failed to write metadata index: %v", err)
+		}
+		store.file = file
+	} else if store.file == nil {
+		if err := store.load(); err != nil {
+			return err
+		}
+		if err := store.compact(); err != nil {
+			return fmt.Errorf("failed to write metadata index: %v", err)
+		}
+	}
+	if _, err := store.file.WriteString(formatSidecarEntry(prefix, entry)); err != nil {
+		return fmt.Errorf("failed to write metadata index: %v", err)
+	}
+	store.entries[prefix] = entry
+	return nil
+}
+
+// compact replaces the index with a new file holding the loaded entries and opens it for appending
+func (store *sidecarMetadataStore) compact() error {
+	tmpPath := store.path + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	for prefix, entry := range store.entries {
+		writer.WriteString(formatSidecarEntry(prefix, entry))
+	}
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, store.path); err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	store.file = file
+	store.compacted = true
+	return nil
+}
+
+// sync flushes the written entries to the disk
+func (store *sidecarMetadataStore) sync() error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.file == nil {
+		return nil
+	}
+	if err := store.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync metadata index: %v", err)
+	}
+	return nil
+}
+
+// close flushes the written entries to the disk and closes the append handle, a later write opens it again
+func (store *sidecarMetadataStore) close() error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.file == nil {
+		return nil
+	}
+	err := store.file.Sync()
+	if closeErr := store.file.Close(); err == nil {
+		err = closeErr
+	}
+	store.file = nil
+	if err != nil {
+		return fmt.Errorf("failed to close metadata index: %v", err)
+	}
+	// The entries are current, so the index is not loaded again
+	if fileInfo, err := os.Stat(store.path); err == nil {
+		store.size = fileInfo.Size()
+		store.modTime = fileInfo.ModTime()
+	}
+	return nil
+}
+
+// syncSidecarMetadataStores flushes the sidecar indexes written in the data directory to the disk
+func syncSidecarMetadataStores(dataPath string) error {
+	sidecarStoresMu.Lock()
+	stores := []*sidecarMetadataStore{}
+	for path, store := range sidecarStores {
+		if filepath.Dir(path) == filepath.Clean(dataPath) {
+			stores = append(stores, store)
+		}
+	}
+	sidecarStoresMu.Unlock()
+	for _, store := range stores {
+		if err := store.sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func formatSidecarEntry(prefix string, entry sidecarEntry) string {
+	return fmt.Sprintf("%s\t%s\t%d\n", prefix, entry.ETag, entry.LastModified.UnixNano())
+}
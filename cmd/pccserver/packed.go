@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/petrkamnev/password-compromise-check-server/pkg/PasswordCompromiseCheckClientLib"
+	"github.com/schollz/progressbar/v3"
+	"github.com/spf13/cobra"
+)
+
+// Packed storage layout (<data>/<mode>.pack):
+//
+//	header: magic "PCCPACK1", uint32 suffix length in hex chars, uint32 prefixes count
+//	index:  HIBPPrefixesCount+1 uint64 offsets of the prefix blocks (relative to the data section)
+//	data:   one block per prefix: uvarint records count, sorted fixed-width suffixes, uvarint counts
+//
+// Suffixes are stored as raw bytes; odd-length hex suffixes are left-padded with a zero nibble.
+// All integers are little-endian.
+const (
+	packedMagic      = "PCCPACK1"
+	packedHeaderSize = len(packedMagic) + 4 + 4
+	packedIndexSize  = (HIBPPrefixesCount + 1) * 8
+)
+
+var packCmd = &cobra.Command{
+	Use:   "pack-storage",
+	Short: "Pack the imported values into the compact binary storage format",
+	Long:  `Convert the imported text prefix files of a hash function into a single packed binary file served directly by the server.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		lock, err := lockStorage(cmd)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		defer lock.unlock()
+		mode, _ := cmd.Flags().GetString("hash-function")
+		if err := validateHashFunction(mode); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		removeText, _ := cmd.Flags().GetBool("remove-text")
+		generation, err := createGeneration()
+		if err != nil {
+			fmt.Printf("Error creating storage generation: %v\n", err)
+			return
+		}
+		generationPath := getGenerationPath(generation)
+		if err := packStorage(generationPath, mode); err != nil {
+			fmt.Printf("Error packing storage: %v\n", err)
+			discardGeneration(generation)
+			return
+		}
+		if removeText {
+			if err := os.RemoveAll(filepath.Join(generationPath, getHashFunctionFolder(mode))); err != nil {
+				fmt.Printf("Error removing text prefix files: %v\n", err)
+				discardGeneration(generation)
+				return
+			}
+		}
+		// The packed values are the ones of the current dataset
+		state, err := readStateFile()
+		if err != nil {
+			fmt.Printf("Error reading state: %v\n", err)
+			discardGeneration(generation)
+			return
+		}
+		if err := activateGeneration(generation, map[string]Dataset{mode: state.Datasets[mode]}, nil); err != nil {
+			fmt.Printf("Error activating storage generation: %v\n", err)
+		}
+	},
+}
+
+func initPackCmd() {
+	packCmd.Flags().String("hash-function", PasswordCompromiseCheckClientLib.DefaultHashFunction, "Hash function of the storage to pack: "+hashFunctionsList())
+	packCmd.Flags().Bool("remove-text", false, "Remove the text prefix files after packing")
+}
+
+func getPackedStoragePath(dataPath, mode string) string {
+	return filepath.Join(dataPath, getHashFunctionFolder(mode)+".pack")
+}
+
+// packStorage converts the text prefix files of the mode in the data directory into the packed file
+func packStorage(dataPath, mode string) error {
+	return writePackedStorage(getPackedStoragePath(dataPath, mode), getSuffixLength(mode), newDirectoryStorage(dataPath, mode))
+}
+
+// writePackedStorage writes the ranges of all prefixes of the source into the packed file
+func writePackedStorage(path string, suffixLength int, source Storage) error {
+	tmpPath := path + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("failed to create packed file: %v", err)
+	}
+	defer os.Remove(tmpPath)
+	defer file.Close()
+
+	header := make([]byte, packedHeaderSize)
+	copy(header, packedMagic)
+	binary.LittleEndian.PutUint32(header[len(packedMagic):], uint32(suffixLength))
+	binary.LittleEndian.PutUint32(header[len(packedMagic)+4:], HIBPPrefixesCount)
+	if _, err := file.Write(header); err != nil {
+		return fmt.Errorf("failed to write packed header: %v", err)
+	}
+	// The index is written after the data, when all block offsets are known
+	dataStart := int64(packedHeaderSize + packedIndexSize)
+	if _, err := file.Seek(dataStart, io.SeekStart); err != nil {
+		return err
+	}
+
+	var bar *progressbar.ProgressBar
+	if !quietFlag {
+		bar = progressbar.Default(HIBPPrefixesCount)
+	}
+
+	index := make([]byte, packedIndexSize)
+	writer := bufio.NewWriterSize(file, 1<<20)
+	var offset uint64
+	for i := 0; i < HIBPPrefixesCount; i++ {
+		prefix := fmt.Sprintf("%05X", i)
+		records, err := source.GetRange(prefix)
+		if err != nil {
+			return fmt.Errorf("failed to read prefix %s: %v", prefix, err)
+		}
+		block := encodePackedBlock(records, suffixLength)
+		if _, err := writer.Write(block); err != nil {
+			return fmt.Errorf("failed to write packed data: %v", err)
+		}
+		binary.LittleEndian.PutUint64(index[i*8:], offset)
+		offset += uint64(len(block))
+		if bar != nil {
+			bar.Add(1)
+		}
+	}
+	binary.LittleEndian.PutUint64(index[HIBPPrefixesCount*8:], offset)
+	if err := writer.Flush(); err != nil {
+		return fmt.Errorf("failed to write packed data: %v", err)
+	}
+	if _, err := file.WriteAt(index, int64(packedHeaderSize)); err != nil {
+		return fmt.Errorf("failed to write packed index: %v", err)
+	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+func decodePackedSuffix(suffix string) ([]byte, error) {
+	if len(suffix)%2 != 0 {
+		suffix = "0" + suffix
+	}
+	return hex.DecodeString(suffix)
+}
+
+func encodePackedSuffix(suffix []byte, suffixLength int) string {
+	encoded := strings.ToUpper(hex.EncodeToString(suffix))
+	return encoded[len(encoded)-suffixLength:]
+}
+
+// encodePackedBlock encodes the valid records of a prefix in the suffix order
+func encodePackedBlock(records []HashRecord, suffixLength int) []byte {
+	valid := make([]HashRecord, 0, len(records))
+	suffixes := make(map[string][]byte, len(records))
+	for _, record := range records {
+		if len(record.Suffix) != suffixLength {
+			continue
+		}
+		suffix, err := decodePackedSuffix(record.Suffix)
+		if err != nil {
+			continue
+		}
+		suffixes[record.Suffix] = suffix
+		valid = append(valid, record)
+	}
+	// Equal-length uppercase hex strings sort the same way as the decoded bytes
+	sort.Slice(valid, func(i, j int) bool {
+		return valid[i].Suffix < valid[j].Suffix
+	})
+
+	block := binary.AppendUvarint(nil, uint64(len(valid)))
+	for _, record := range valid {
+		block = append(block, suffixes[record.Suffix]...)
+	}
+	for _, record := range valid {
+		block = binary.AppendUvarint(block, record.Count)
+	}
+	return block
+}
+
+// packedStorage provides read access to a packed file
+type packedStorage struct {
+	file         *os.File
+	suffixLength int
+	suffixWidth  int
+	fileInfo     os.FileInfo
+}
+
+func openPackedStorage(path string) (*packedStorage, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, packedHeaderSize)
+	if _, err := file.ReadAt(header, 0); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to read packed header: %v", err)
+	}
+	if string(header[:len(packedMagic)]) != packedMagic ||
+		binary.LittleEndian.Uint32(header[len(packedMagic)+4:]) != HIBPPrefixesCount {
+		file.Close()
+		return nil, errors.New("invalid packed file header")
+	}
+	fileInfo, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	suffixLength := int(binary.LittleEndian.Uint32(header[len(packedMagic):]))
+	return &packedStorage{
+		file:         file,
+		suffixLength: suffixLength,
+		suffixWidth:  (suffixLength + 1) / 2,
+		fileInfo:     fileInfo,
+	}, nil
+}
+
+func (storage *packedStorage) Close() error {
+	return storage.file.Close()
+}
+
+// readBlock returns the raw block of the prefix (given as an integer from 0 to 0xFFFFF)
+func (storage *packedStorage) readBlock(prefix int) ([]byte, error) {
+	offsets := make([]byte, 16)
+	if _, err := storage.file.ReadAt(offsets, int64(packedHeaderSize+prefix*8)); err != nil {
+		return nil, fmt.Errorf("failed to read packed index: %v", err)
+	}
+	start := binary.LittleEndian.Uint64(offsets)
+	end := binary.LittleEndian.Uint64(offsets[8:])
+	if end < start {
+		return nil, errors.New("corrupted packed index")
+	}
+	block := make([]byte, end-start)
+	if _, err := storage.file.ReadAt(block, int64(packedHeaderSize+packedIndexSize)+int64(start)); err != nil {
+		return nil, fmt.Errorf("failed to read packed data: %v", err)
+	}
+	return block, nil
+}
+
+// decodeBlock splits the block into the suffixes section and the counts section
+func (storage *packedStorage) decodeBlock(block []byte) (int, []byte, []byte, error) {
+	count, n := binary.Uvarint(block)
+	if n <= 0 || uint64(len(block)-n) < count*uint64(storage.suffixWidth) {
+		return 0, nil, nil, errors.New("corrupted packed block")
+	}
+	suffixesEnd := n + int(count)*storage.suffixWidth
+	return int(count), block[n:suffixesEnd], block[suffixesEnd:], nil
+}
+
+func (storage *packedStorage) GetRange(prefix string) ([]HashRecord, error) {
+	prefixValue, err := parsePrefix(prefix)
+	if err != nil {
+		return nil, errPrefixNotFound
+	}
+	block, err := storage.readBlock(prefixValue)
+	if err != nil {
+		return nil, err
+	}
+	recordsCount, suffixes, counts, err := storage.decodeBlock(block)
+	if err != nil {
+		return nil, err
+	}
+	records := make([]HashRecord, 0, recordsCount)
+	for i := 0; i < recordsCount; i++ {
+		count, n := binary.Uvarint(counts)
+		if n <= 0 {
+			return nil, errors.New("corrupted packed block")
+		}
+		counts = counts[n:]
+		suffix := suffixes[i*storage.suffixWidth : (i+1)*storage.suffixWidth]
+		records = append(records, HashRecord{Suffix: encodePackedSuffix(suffix, storage.suffixLength), Count: count})
+	}
+	return records, nil
+}
+
+func (storage *packedStorage) LookupSuffix(prefix, suffix string) (uint64, error) {
+	prefixValue, err := parsePrefix(prefix)
+	if err != nil || len(suffix) != storage.suffixLength {
+		return 0, nil
+	}
+	needle, err := decodePackedSuffix(suffix)
+	if err != nil {
+		return 0, nil
+	}
+	block, err := storage.readBlock(prefixValue)
+	if err != nil {
+		return 0, err
+	}
+	recordsCount, suffixes, counts, err := storage.decodeBlock(block)
+	if err != nil {
+		return 0, err
+	}
+	width := storage.suffixWidth
+	position := sort.Search(recordsCount, func(i int) bool {
+		return string(suffixes[i*width:(i+1)*width]) >= string(needle)
+	})
+	if position == recordsCount || string(suffixes[position*width:(position+1)*width]) != string(needle) {
+		return 0, nil
+	}
+	// Counts are variable-length, so skip the preceding ones
+	for i := 0; i <= position; i++ {
+		count, n := binary.Uvarint(counts)
+		if n <= 0 {
+			return 0, errors.New("corrupted packed block")
+		}
+		if i == position {
+			return count, nil
+		}
+		counts = counts[n:]
+	}
+	return 0, nil
+}
+
+func (storage *packedStorage) PutRange(prefix string, records []HashRecord, metadata PrefixMetadata) error {
+	return errors.New("packed storage is read-only, import into the directory storage and run pack-storage")
+}
+
+func (storage *packedStorage) ListPrefixes() ([]string, error) {
+	prefixes := make([]string, HIBPPrefixesCount)
+	for i := range prefixes {
+		prefixes[i] = fmt.Sprintf("%05X", i)
+	}
+	return prefixes, nil
+}
+
+// Metadata uses the packed file modification time and the checksum of the prefix block as the ETag
+func (storage *packedStorage) Metadata(prefix string) (PrefixMetadata, error) {
+	prefixValue, err := parsePrefix(prefix)
+	if err != nil {
+		return PrefixMetadata{}, errPrefixNotFound
+	}
+	block, err := storage.readBlock(prefixValue)
+	if err != nil {
+		return PrefixMetadata{}, err
+	}
+	return PrefixMetadata{
+		ETag:         fmt.Sprintf("\"%08x\"", crc32.ChecksumIEEE(block)),
+		LastModified: storage.fileInfo.ModTime(),
+	}, nil
+}
+
+// parsePrefix converts a 5-char hex prefix into an integer
+func parsePrefix(prefix string) (int, error) {
+	if len(prefix) != 5 {
+		return 0, errors.New("the hash prefix was not in a valid format")
+	}
+	value, err := strconv.ParseUint(prefix, 16, 32)
+	if err != nil {
+		return 0, errors.New("the hash prefix was not in a valid format")
+	}
+	return int(value), nil
+}
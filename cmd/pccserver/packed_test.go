@@ -0,0 +1,125 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// sparseStorage reads the prefixes not written to the directory storage as empty ranges,
+// so the packed fixtures do not need a file for every prefix
+type sparseStorage struct {
+	Storage
+	written map[string][]HashRecord
+}
+
+func (storage sparseStorage) GetRange(prefix string) ([]HashRecord, error) {
+	if _, found := storage.written[prefix]; !found {
+		return nil, nil
+	}
+	return storage.Storage.GetRange(prefix)
+}
+
+// writeTestPack writes the ranges into a directory storage and packs it
+func writeTestPack(t *testing.T, mode string, ranges map[string][]HashRecord) string {
+	t.Helper()
+	quietFlag = true
+	metadataStoreFlag = metadataStoreXattr
+	dataPath := t.TempDir()
+	source := newWritableDirectoryStorage(dataPath, mode)
+	for prefix, records := range ranges {
+		if err := source.PutRange(prefix, records, PrefixMetadata{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := getPackedStoragePath(dataPath, mode)
+	if err := writePackedStorage(path, getSuffixLength(mode), sparseStorage{Storage: source, written: ranges}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("the temporary packed file is left: %v", err)
+	}
+	return path
+}
+
+func TestPackedRoundTrip(t *testing.T) {
+	tests := []struct {
+		mode         string
+		suffixLength int
+	}{
+		{"sha1", 35},
+		{"ntlm", 27},
+		{"sha256", 59},
+	}
+	for _, test := range tests {
+		t.Run(test.mode, func(t *testing.T) {
+			if length := getSuffixLength(test.mode); length != test.suffixLength {
+				t.Fatalf("suffix length of %s is %d, want %d", test.mode, length, test.suffixLength)
+			}
+			suffix := func(digit string) string {
+				return strings.Repeat(digit, test.suffixLength)
+			}
+			// Unsorted, with counts of several uvarint lengths and records of other lengths to skip
+			records := []HashRecord{
+				{Suffix: suffix("F"), Count: 1 << 40},
+				{Suffix: suffix("0"), Count: 1},
+				{Suffix: "A" + suffix("1")[1:], Count: 300},
+				{Suffix: suffix("9"), Count: 0},
+				{Suffix: suffix("1") + "1", Count: 5},
+				{Suffix: suffix("G"), Count: 7},
+			}
+			storage, err := openPackedStorage(writeTestPack(t, test.mode, map[string][]HashRecord{
+				"00000": records,
+				"FFFFF": records[:1],
+			}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer storage.Close()
+
+			expected := append([]HashRecord{}, records[:4]...)
+			sort.Slice(expected, func(i, j int) bool { return expected[i].Suffix < expected[j].Suffix })
+			got, err := storage.GetRange("00000")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, expected) {
+				t.Errorf("GetRange(00000) = %v, want %v", got, expected)
+			}
+			got, err = storage.GetRange("FFFFF")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, records[:1]) {
+				t.Errorf("GetRange(FFFFF) = %v, want %v", got, records[:1])
+			}
+			got, err = storage.GetRange("12345")
+			if err != nil || len(got) != 0 {
+				t.Errorf("GetRange(12345) = %v, %v, want no records", got, err)
+			}
+
+			for _, record := range expected {
+				count, err := storage.LookupSuffix("00000", record.Suffix)
+				if err != nil || count != record.Count {
+					t.Errorf("LookupSuffix(00000, %s) = %d, %v, want %d", record.Suffix, count, err, record.Count)
+				}
+				// Lowercase suffixes decode to the same bytes
+				count, err = storage.LookupSuffix("00000", strings.ToLower(record.Suffix))
+				if err != nil || count != record.Count {
+					t.Errorf("LookupSuffix(00000, lowercase %s) = %d, %v, want %d", record.Suffix, count, err, record.Count)
+				}
+			}
+			for _, missing := range []string{suffix("2"), suffix("1") + "1", suffix("G"), ""} {
+				count, err := storage.LookupSuffix("00000", missing)
+				if err != nil || count != 0 {
+					t.Errorf("LookupSuffix(00000, %q) = %d, %v, want 0", missing, count, err)
+				}
+			}
+			if count, err := storage.LookupSuffix("FFFFF", suffix("0")); err != nil || count != 0 {
+				t.Errorf("LookupSuffix(FFFFF, %s) = %d, %v, want 0", suffix("0"), count, err)
+			}
+		})
+	}
+}
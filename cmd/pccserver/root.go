@@ -19,15 +19,45 @@ var (
 
 func init() {
 	rootCmd.PersistentFlags().BoolVarP(&quietFlag, "quiet", "q", false, "Suppress messages, animations, and interactivity, only display errors and important messages")
+	rootCmd.PersistentFlags().StringVar(&metadataStoreFlag, "metadata-store", metadataStoreAuto, "Store of the ETag and Last-Modified metadata of the prefix files: \"auto\" (extended attributes if the filesystem supports them), \"xattr\", \"sidecar\" (index file per hash function)")
+	rootCmd.PersistentFlags().StringVar(&configFlag, "config", "", "Configuration file (YAML), by default the PCCSERVER_CONFIG environment variable")
+	rootCmd.PersistentFlags().StringVar(&storageFlag, "storage", "", "Storage directory, by default the PCCSERVER_STORAGE environment variable or the user configuration directory")
+	rootCmd.PersistentFlags().StringVar(&logFileFlag, "log-file", "", "File the log messages are appended to instead of the standard error")
+	rootCmd.PersistentPreRun = func(cmd *cobra.Command, args []string) {
+		if err := applyConfig(cmd); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
 	rootCmd.Root().CompletionOptions.DisableDefaultCmd = true
 	initServerCmd()
 	initImportCmd()
 	initExportCmd()
 	initOutputStateCmd()
+	initPackCmd()
+	initRollbackCmd()
+	initMergeCmd()
+	initExcludeCmd()
+	initVerifyCmd()
+	initSignCmds()
+	initBackupCmds()
+	initConfigCmd()
+	initAPIKeyCmd()
 	rootCmd.AddCommand(serverCmd)
 	rootCmd.AddCommand(importCmd)
 	rootCmd.AddCommand(exportCmd)
 	rootCmd.AddCommand(outputStateCmd)
+	rootCmd.AddCommand(packCmd)
+	rootCmd.AddCommand(rollbackCmd)
+	rootCmd.AddCommand(mergeCmd)
+	rootCmd.AddCommand(excludeCmd)
+	rootCmd.AddCommand(verifyCmd)
+	rootCmd.AddCommand(signCmd)
+	rootCmd.AddCommand(verifySignatureCmd)
+	rootCmd.AddCommand(backupCmd)
+	rootCmd.AddCommand(restoreCmd)
+	rootCmd.AddCommand(configCmd)
+	rootCmd.AddCommand(apiKeyCmd)
 }
 
 func Execute() {
@@ -38,7 +68,10 @@ func Execute() {
 }
 
 func getStoragePath() string {
-	storagePath := os.Getenv("PCCSERVER_STORAGE")
+	storagePath := storageFlag
+	if storagePath == "" {
+		storagePath = os.Getenv("PCCSERVER_STORAGE")
+	}
 	if storagePath == "" {
 		configDir, err := os.UserConfigDir()
 		if err != nil {
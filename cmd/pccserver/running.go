@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Every running server records itself in <storage>/servers/<id>.json, so output-state can list
+// the servers and the protocols they serve, and pruning keeps the generations they serve. The server
+// holds an exclusive flock of <storage>/servers/<id>.lock while it runs: a record whose lock is not held
+// is stale, whatever PID namespace or host it was written from. The generations of the record are the
+// ones of the snapshots still in use, including the previous ones finishing requests after a reload.
+const runningServersDirectory = "servers"
+
+// RunningServer describes a run-server process serving the storage
+type RunningServer struct {
+	ID        string    `json:"id"`
+	PID       int       `json:"pid"`
+	Host      string    `json:"host"`
+	Address   string    `json:"address"`
+	Protocols []string  `json:"protocols"`
+	StartedAt time.Time `json:"started_at"`
+	// Generations of the snapshots the server holds
+	Generations []string `json:"generations,omitempty"`
+}
+
+var (
+	runningServerMu sync.Mutex
+	// Record of this process, nil unless it runs a server
+	runningServerRecord *RunningServer
+	// Lock file held while the server runs
+	runningServerLease *os.File
+)
+
+func getRunningServerPath(id, extension string) string {
+	return filepath.Join(getStoragePath(), runningServersDirectory, id+extension)
+}
+
+func registerRunningServer(address string, protocols []string, generations []string) error {
+	if err := os.MkdirAll(filepath.Join(getStoragePath(), runningServersDirectory), 0755); err != nil {
+		return err
+	}
+	removeStaleRunningServers()
+	id, err := randomHex(8)
+	if err != nil {
+		return err
+	}
+	lease, err := os.OpenFile(getRunningServerPath(id, ".lock"), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if err := syscall.Flock(int(lease.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		lease.Close()
+		os.Remove(lease.Name())
+		return fmt.Errorf("failed to lock the server record: %v", err)
+	}
+	// A concurrent removal of the stale records may have removed the file before it was locked
+	if info, err := os.Stat(lease.Name()); err != nil || !sameFile(lease, info) {
+		lease.Close()
+		return fmt.Errorf("the server record lock was removed")
+	}
+	host, _ := os.Hostname()
+	record := &RunningServer{
+		ID:          id,
+		PID:         os.Getpid(),
+		Host:        host,
+		Address:     address,
+		Protocols:   protocols,
+		StartedAt:   time.Now().UTC(),
+		Generations: generations,
+	}
+	if err := writeJSONFile(getRunningServerPath(id, ".json"), record); err != nil {
+		lease.Close()
+		os.Remove(lease.Name())
+		return err
+	}
+	runningServerMu.Lock()
+	defer runningServerMu.Unlock()
+	runningServerRecord = record
+	runningServerLease = lease
+	return nil
+}
+
+// updateRunningServerGenerations records the generations of the snapshots the server of this process holds
+func updateRunningServerGenerations(generations []string) {
+	runningServerMu.Lock()
+	defer runningServerMu.Unlock()
+	if runningServerRecord == nil || strings.Join(runningServerRecord.Generations, ",") == strings.Join(generations, ",") {
+		return
+	}
+	runningServerRecord.Generations = generations
+	if err := writeJSONFile(getRunningServerPath(runningServerRecord.ID, ".json"), runningServerRecord); err != nil {
+		fmt.Printf("Error updating the server record: %v\n", err)
+	}
+}
+
+func unregisterRunningServer() {
+	runningServerMu.Lock()
+	defer runningServerMu.Unlock()
+	if runningServerRecord == nil {
+		return
+	}
+	// The record is removed while the lock is held, so it is never read as a live record without a lock
+	os.Remove(getRunningServerPath(runningServerRecord.ID, ".json"))
+	os.Remove(runningServerLease.Name())
+	runningServerLease.Close()
+	runningServerRecord = nil
+}
+
+// servedGenerations returns the generations held by the running servers
+func servedGenerations() map[string]bool {
+	generations := map[string]bool{}
+	for _, server := range listRunningServers() {
+		for _, generation := range server.Generations {
+			generations[generation] = true
+		}
+	}
+	return generations
+}
+
+// isRunningServerLeaseHeld reports whether a running server holds the lock of the record
+func isRunningServerLeaseHeld(id string) bool {
+	lease, err := os.Open(getRunningServerPath(id, ".lock"))
+	if err != nil {
+		return false
+	}
+	defer lease.Close()
+	return syscall.Flock(int(lease.Fd()), syscall.LOCK_SH|syscall.LOCK_NB) == syscall.EWOULDBLOCK
+}
+
+// listRunningServers returns the recorded servers holding the lock of their records. It only reads the records.
+func listRunningServers() []RunningServer {
+	paths, _ := filepath.Glob(filepath.Join(getStoragePath(), runningServersDirectory, "*.json"))
+	servers := []RunningServer{}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		var server RunningServer
+		if err := json.Unmarshal(data, &server); err != nil || server.ID == "" {
+			continue
+		}
+		if !isRunningServerLeaseHeld(server.ID) {
+			continue
+		}
+		servers = append(servers, server)
+	}
+	sort.Slice(servers, func(i, j int) bool {
+		return servers[i].StartedAt.Before(servers[j].StartedAt)
+	})
+	return servers
+}
+
+// removeStaleRunningServers removes the records of the servers which exited without unregistering
+func removeStaleRunningServers() {
+	paths, _ := filepath.Glob(filepath.Join(getStoragePath(), runningServersDirectory, "*.lock"))
+	for _, path := range paths {
+		lease, err := os.OpenFile(path, os.O_RDWR, 0)
+		if err != nil {
+			continue
+		}
+		// The lock is taken before removing, so a live server's record is never removed
+		if syscall.Flock(int(lease.Fd()), syscall.LOCK_EX|syscall.LOCK_NB) == nil {
+			os.Remove(strings.TrimSuffix(path, ".lock") + ".json")
+			os.Remove(path)
+		}
+		lease.Close()
+	}
+	// Records without a lock file are left by the versions recording the servers by PID
+	paths, _ = filepath.Glob(filepath.Join(getStoragePath(), runningServersDirectory, "*.json"))
+	for _, path := range paths {
+		if _, err := os.Stat(strings.TrimSuffix(path, ".json") + ".lock"); os.IsNotExist(err) {
+			os.Remove(path)
+		}
+	}
+}
+
+func sameFile(file *os.File, info os.FileInfo) bool {
+	fileInfo, err := file.Stat()
+	return err == nil && os.SameFile(fileInfo, info)
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// run-server keeps the served generation in memory as a dataset snapshot. A reload (SIGHUP, the admin
+// endpoint or a change of state.json, exclusions.json or apikeys.json) loads a new snapshot and swaps it in: the
+// requests in flight finish against the old snapshot, which is closed when the last of them releases it.
+
+// servedDataset is an immutable snapshot of the served generation
+type servedDataset struct {
+	// Resolved directory of the generation
+	dataPath      string
+	hashFunctions []string
+	// Storages of the hash functions without the excluded hashes
+	storages map[string]Storage
+	// API keys by the hash of the key
+	apiKeys map[string]APIKey
+	// References of the requests using the snapshot, plus one while it is current
+	refs atomic.Int64
+	// Server which loaded the snapshot
+	server *datasetServer
+}
+
+// datasetServer holds the current snapshot
+type datasetServer struct {
+	current atomic.Pointer[servedDataset]
+	// Public key verifying the manifest signatures of the loaded generations, nil if not required
+	publicKey ed25519.PublicKey
+	reloadMu  sync.Mutex
+	// Numbers of the snapshots of each generation not closed yet, recorded in the server record so that
+	// pruning keeps the generations still used by the requests in flight
+	heldMu sync.Mutex
+	held   map[string]int
+}
+
+var served datasetServer
+
+// loadServedDataset opens the storages of the currently served generation
+func (server *datasetServer) loadServedDataset() (*servedDataset, error) {
+	state, err := readStateFile()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state file: %v", err)
+	}
+	if len(state.SupportedHashFunctions) == 0 {
+		return nil, fmt.Errorf("no hash functions are imported")
+	}
+	exclusions, err := readExclusions()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read exclusions: %v", err)
+	}
+	keys, err := readAPIKeys()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read API keys: %v", err)
+	}
+	// The generation is resolved, so the snapshot keeps serving it after the current link is switched
+	dataPath, err := filepath.EvalSymlinks(getDataPath())
+	if err != nil {
+		return nil, err
+	}
+	dataset := &servedDataset{
+		dataPath:      dataPath,
+		hashFunctions: state.SupportedHashFunctions,
+		storages:      map[string]Storage{},
+		apiKeys:       map[string]APIKey{},
+		server:        server,
+	}
+	// The generation is held before its storages are opened, so it is not pruned meanwhile
+	server.hold(dataset.generation())
+	for _, key := range keys {
+		dataset.apiKeys[key.Hash] = key
+	}
+	for _, mode := range state.SupportedHashFunctions {
+		storage, err := openStorage(dataPath, mode)
+		if err != nil {
+			dataset.close()
+			return nil, fmt.Errorf("failed to open %s storage: %v", mode, err)
+		}
+		// The ranges of a signed generation are checked against the signed manifest when they are read
+		if server.publicKey != nil {
+			signed, err := withSignedManifest(storage, dataPath, mode, server.publicKey)
+			if err != nil {
+				storage.Close()
+				dataset.close()
+				return nil, fmt.Errorf("the storage signature does not verify: %v", err)
+			}
+			storage = signed
+		}
+		dataset.storages[mode] = withServedExclusions(storage, exclusions, mode)
+	}
+	dataset.refs.Store(1)
+	return dataset, nil
+}
+
+// storage returns the storage of the hash function, false if the hash function is not served
+func (dataset *servedDataset) storage(mode string) (Storage, bool) {
+	storage, found := dataset.storages[mode]
+	return storage, found
+}
+
+// generation returns the ID of the served generation, empty for the data kept in the storage root
+func (dataset *servedDataset) generation() string {
+	if filepath.Base(filepath.Dir(dataset.dataPath)) != generationsDirectory {
+		return ""
+	}
+	return filepath.Base(dataset.dataPath)
+}
+
+func (dataset *servedDataset) release() {
+	if dataset.refs.Add(-1) == 0 {
+		dataset.close()
+	}
+}
+
+func (dataset *servedDataset) close() {
+	for _, storage := range dataset.storages {
+		storage.Close()
+	}
+	dataset.server.unhold(dataset.generation())
+}
+
+// hold counts a snapshot of the generation
+func (server *datasetServer) hold(generation string) {
+	server.heldMu.Lock()
+	defer server.heldMu.Unlock()
+	if server.held == nil {
+		server.held = map[string]int{}
+	}
+	server.held[generation]++
+	updateRunningServerGenerations(server.heldGenerationsLocked())
+}
+
+// unhold uncounts a closed snapshot of the generation
+func (server *datasetServer) unhold(generation string) {
+	server.heldMu.Lock()
+	defer server.heldMu.Unlock()
+	if server.held[generation]--; server.held[generation] <= 0 {
+		delete(server.held, generation)
+	}
+	updateRunningServerGenerations(server.heldGenerationsLocked())
+}
+
+// heldGenerations returns the generations of the snapshots not closed yet
+func (server *datasetServer) heldGenerations() []string {
+	server.heldMu.Lock()
+	defer server.heldMu.Unlock()
+	return server.heldGenerationsLocked()
+}
+
+func (server *datasetServer) heldGenerationsLocked() []string {
+	generations := []string{}
+	for generation := range server.held {
+		// The data kept in the storage root is not a generation
+		if generation != "" {
+			generations = append(generations, generation)
+		}
+	}
+	sort.Strings(generations)
+	return generations
+}
+
+// acquire returns the current snapshot, which the caller releases when done
+func (server *datasetServer) acquire() *servedDataset {
+	for {
+		dataset := server.current.Load()
+		refs := dataset.refs.Load()
+		// A snapshot without references has been swapped out and closed meanwhile
+		if refs > 0 && dataset.refs.CompareAndSwap(refs, refs+1) {
+			return dataset
+		}
+	}
+}
+
+// reload loads the current generation and swaps it in. If it cannot be loaded, the previous snapshot is kept.
+func (server *datasetServer) reload() (*servedDataset, error) {
+	server.reloadMu.Lock()
+	defer server.reloadMu.Unlock()
+	dataset, err := server.loadServedDataset()
+	if err != nil {
+		return nil, err
+	}
+	if previous := server.current.Swap(dataset); previous != nil {
+		previous.release()
+	}
+	return dataset, nil
+}
+
+// reloadAndReport reloads the snapshot and reports the result on behalf of the trigger
+func (server *datasetServer) reloadAndReport(trigger string) {
+	dataset, err := server.reload()
+	if err != nil {
+		fmt.Printf("Error reloading the dataset (%s): %v, the previous dataset is still served\n", trigger, err)
+		return
+	}
+	if !quietFlag {
+		fmt.Printf("Reloaded the dataset (%s): %s, hash functions %v\n", trigger, filepath.Base(dataset.dataPath), dataset.hashFunctions)
+	}
+}
+
+// watchState reloads the snapshot when state.json, exclusions.json or apikeys.json is replaced. The events are
+// debounced, as the commands replace the files through renames.
+func (server *datasetServer) watchState() error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	// The files are replaced by renames, so the directory is watched instead of the files
+	if err := watcher.Add(getStoragePath()); err != nil {
+		watcher.Close()
+		return err
+	}
+	go func() {
+		defer watcher.Close()
+		var timer *time.Timer
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				name := filepath.Base(event.Name)
+				if name != "state.json" && name != "exclusions.json" && name != "apikeys.json" {
+					continue
+				}
+				if event.Op&(fsnotify.Create|fsnotify.Write|fsnotify.Rename) == 0 {
+					continue
+				}
+				if timer == nil {
+					timer = time.AfterFunc(250*time.Millisecond, func() { server.reloadAndReport("state file changed") })
+				} else {
+					timer.Reset(250 * time.Millisecond)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("Error watching the state file: %v", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// handleReload serves the admin reload endpoint
+func handleReload(w http.ResponseWriter, r *http.Request) {
+	dataset, err := served.reload()
+	if err != nil {
+		fmt.Printf("Error reloading the dataset (admin request): %v, the previous dataset is still served\n", err)
+		http.Error(w, fmt.Sprintf("Failed to reload the dataset: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if !quietFlag {
+		fmt.Printf("Reloaded the dataset (admin request): %s, hash functions %v\n", filepath.Base(dataset.dataPath), dataset.hashFunctions)
+	}
+	fmt.Fprintf(w, "Reloaded generation %s, hash functions %v\n", filepath.Base(dataset.dataPath), dataset.hashFunctions)
+}
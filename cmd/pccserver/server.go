@@ -1,15 +1,16 @@
 package main
 
 import (
-	"bufio"
+	"context"
+	"crypto/tls"
 	"fmt"
 	"math/rand"
 	"net/http"
-	"path/filepath"
-	"strconv"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"io"
-	"os"
 	"strings"
 	"time"
 
@@ -18,7 +19,6 @@ import (
 	psi_ds "github.com/openmined/psi/datastructure"
 	psi_proto "github.com/openmined/psi/pb"
 	psi_server "github.com/openmined/psi/server"
-	"github.com/pkg/xattr"
 	"google.golang.org/protobuf/proto"
 )
 
@@ -30,194 +30,361 @@ var serverCmd = &cobra.Command{
 		port, _ := cmd.Flags().GetInt("port")
 		addr := fmt.Sprintf(":%d", port)
 		mode, _ := cmd.Flags().GetString("mode")
-		if mode == "psi" {
-			http.HandleFunc("/psi/", handlePSI)
-		} else if mode == "hash" {
-			http.HandleFunc("/range/", handleRange)
-			http.HandleFunc("/pwnedpassword/", handlePwnedPassword)
-		} else {
-			fmt.Println("Error: incorrect \"mode\" option value")
+		protocols, err := parseProtocols(mode)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
 			return
 		}
 
-		supportedHashFunctions, err := getSupportedHashFunctions()
-		if err != nil || len(supportedHashFunctions) == 0 {
-			fmt.Printf("Error: No hash functions are imported or unable to read state: %v\n", err)
+		// With "require-signed" the generations are served only if their manifests are signed with the public key
+		requireSigned, _ := cmd.Flags().GetBool("require-signed")
+		if requireSigned {
+			publicKeyPath, _ := cmd.Flags().GetString("public-key")
+			if publicKeyPath == "" {
+				fmt.Println("Error: \"require-signed\" requires the \"public-key\" option")
+				return
+			}
+			served.publicKey, err = loadPublicKey(publicKeyPath)
+			if err != nil {
+				fmt.Printf("Error loading public key: %v\n", err)
+				return
+			}
+		}
+		dataset, err := served.reload()
+		if err != nil {
+			fmt.Printf("Error loading the dataset: %v\n", err)
+			return
+		}
+		watchState, _ := cmd.Flags().GetBool("watch-state")
+		if watchState {
+			if err := served.watchState(); err != nil {
+				fmt.Printf("Error watching the state file: %v\n", err)
+				return
+			}
+		}
+
+		// With a TLS certificate the listeners serve HTTPS, with a client CA the endpoints
+		// listed in "require-client-cert" are served only to the clients with verified certificates
+		tlsCert, _ := cmd.Flags().GetString("tls-cert")
+		tlsKey, _ := cmd.Flags().GetString("tls-key")
+		tlsClientCA, _ := cmd.Flags().GetString("tls-client-ca")
+		var tlsConfig *tls.Config
+		if tlsCert != "" || tlsKey != "" {
+			tlsConfig, err = newServerTLSConfig(tlsCert, tlsKey, tlsClientCA)
+			if err != nil {
+				fmt.Printf("Error configuring TLS: %v\n", err)
+				return
+			}
+		} else if tlsClientCA != "" {
+			fmt.Println("Error: \"tls-client-ca\" requires the \"tls-cert\" and \"tls-key\" options")
+			return
+		}
+		requireClientCert, _ := cmd.Flags().GetString("require-client-cert")
+		clientCertEndpoints, err := parseClientCertEndpoints(requireClientCert)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		if len(clientCertEndpoints) > 0 && tlsClientCA == "" {
+			fmt.Println("Error: \"require-client-cert\" requires the \"tls-client-ca\" option")
 			return
 		}
+		// With "require-api-key" the protocol endpoints are served only with an API key allowing them
+		requireKey, _ := cmd.Flags().GetBool("require-api-key")
+		endpoint := func(name string, handler http.HandlerFunc) http.HandlerFunc {
+			if requireKey {
+				switch name {
+				case "range", "pwnedpassword":
+					handler = requireAPIKey(protocolHash, handler)
+				case "psi":
+					handler = requireAPIKey(protocolPSI, handler)
+				}
+			}
+			if clientCertEndpoints[name] {
+				return requireClientCertificate(handler)
+			}
+			return handler
+		}
+
+		mux := http.NewServeMux()
+		for _, protocol := range protocols {
+			switch protocol {
+			case protocolHash:
+				mux.HandleFunc("/range/", allowMethods(endpoint("range", handleRange), http.MethodGet, http.MethodHead))
+				mux.HandleFunc("/pwnedpassword/", allowMethods(endpoint("pwnedpassword", handlePwnedPassword), http.MethodGet, http.MethodHead))
+			case protocolPSI:
+				mux.HandleFunc("/psi/", allowMethods(endpoint("psi", handlePSI), http.MethodPost))
+			}
+		}
+
+		readTimeout, _ := cmd.Flags().GetDuration("read-timeout")
+		writeTimeout, _ := cmd.Flags().GetDuration("write-timeout")
+		idleTimeout, _ := cmd.Flags().GetDuration("idle-timeout")
+		shutdownTimeout, _ := cmd.Flags().GetDuration("shutdown-timeout")
+		servers := []*http.Server{{
+			Addr:         addr,
+			Handler:      mux,
+			TLSConfig:    tlsConfig,
+			ReadTimeout:  readTimeout,
+			WriteTimeout: writeTimeout,
+			IdleTimeout:  idleTimeout,
+		}}
+		// The admin endpoints are served on a separate (usually local) address
+		adminAddress, _ := cmd.Flags().GetString("admin-address")
+		if adminAddress != "" {
+			adminMux := http.NewServeMux()
+			adminMux.HandleFunc("/admin/reload", allowMethods(endpoint("admin", handleReload), http.MethodPost))
+			servers = append(servers, &http.Server{
+				Addr:         adminAddress,
+				Handler:      adminMux,
+				TLSConfig:    tlsConfig,
+				ReadTimeout:  readTimeout,
+				WriteTimeout: writeTimeout,
+				IdleTimeout:  idleTimeout,
+			})
+		}
+
+		if err := registerRunningServer(addr, protocols, served.heldGenerations()); err != nil {
+			fmt.Printf("Error registering server: %v\n", err)
+		}
+		defer unregisterRunningServer()
 
 		if !quietFlag {
-			fmt.Printf("Server started on localhost%s\nSupported hash functions: %v\n", addr, supportedHashFunctions)
+			scheme := "http"
+			if tlsConfig != nil {
+				scheme = "https"
+			}
+			fmt.Printf("Server started on %s://localhost%s\nProtocols: %s\nSupported hash functions: %v\n", scheme, addr, strings.Join(protocols, ", "), dataset.hashFunctions)
+			if adminAddress != "" {
+				fmt.Printf("Admin endpoint: POST %s://%s/admin/reload\n", scheme, adminAddress)
+			}
+			if requireKey {
+				fmt.Printf("API keys required, %d configured\n", len(dataset.apiKeys))
+			}
+			if len(clientCertEndpoints) > 0 {
+				fmt.Printf("Client certificates required for: %s\n", requireClientCert)
+			}
 		}
-		if err := http.ListenAndServe(addr, nil); err != nil {
-			fmt.Println("Error starting server:", err)
+		if err := runServer(servers, shutdownTimeout); err != nil {
+			fmt.Println("Error running server:", err)
+			unregisterRunningServer()
+			os.Exit(1)
 		}
 	},
 }
 
-func initServerCmd() {
-	serverCmd.Flags().IntP("port", "p", 8080, "Port to run the server on")
-	serverCmd.Flags().StringP("mode", "m", "hash", "Password checking mode (protocol): \"hash\", \"psi\"")
-}
+// runServer serves until SIGINT or SIGTERM, then stops accepting connections and waits
+// for the in-flight requests until the shutdown timeout. SIGHUP reloads the dataset.
+func runServer(servers []*http.Server, shutdownTimeout time.Duration) error {
+	serveErr := make(chan error, len(servers))
+	for _, server := range servers {
+		go func(server *http.Server) {
+			if server.TLSConfig != nil {
+				// The certificate is provided by TLSConfig.GetCertificate
+				serveErr <- server.ListenAndServeTLS("", "")
+				return
+			}
+			serveErr <- server.ListenAndServe()
+		}(server)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(signals)
+	for stopping := false; !stopping; {
+		select {
+		case err := <-serveErr:
+			for _, server := range servers {
+				server.Close()
+			}
+			return err
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				served.reloadAndReport("SIGHUP")
+				continue
+			}
+			if !quietFlag {
+				fmt.Printf("Received %v, shutting down...\n", sig)
+			}
+			stopping = true
+		}
+	}
 
-func handleRange(w http.ResponseWriter, r *http.Request) {
-	prefix := strings.ToUpper(strings.TrimPrefix(r.URL.Path, "/range/"))
-	mode := r.URL.Query().Get("mode")
-	if mode != "ntlm" {
-		mode = "sha1"
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	var shutdownErr error
+	for _, server := range servers {
+		if err := server.Shutdown(ctx); err != nil {
+			server.Close()
+			shutdownErr = fmt.Errorf("the in-flight requests did not finish in %v: %v", shutdownTimeout, err)
+		}
 	}
+	if shutdownErr != nil {
+		return shutdownErr
+	}
+	if !quietFlag {
+		fmt.Println("Server stopped")
+	}
+	return nil
+}
 
-	// Check if the requested mode is supported
-	supportedHashFunctions, err := getSupportedHashFunctions()
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("Error checking supported hash functions"))
-		return
+// Protocols served by run-server
+const (
+	// k-anonymity ranges (/range/) and full hash lookups (/pwnedpassword/)
+	protocolHash = "hash"
+	// Private set intersection (/psi/)
+	protocolPSI = "psi"
+)
+
+// parseProtocols parses the comma-separated "mode" option value
+func parseProtocols(value string) ([]string, error) {
+	protocols := []string{}
+	for _, protocol := range strings.Split(value, ",") {
+		protocol = strings.TrimSpace(protocol)
+		if protocol != protocolHash && protocol != protocolPSI {
+			return nil, fmt.Errorf("incorrect \"mode\" option value %q. Allowed values: \"hash\", \"psi\" or both separated by a comma", protocol)
+		}
+		duplicate := false
+		for _, enabled := range protocols {
+			if enabled == protocol {
+				duplicate = true
+			}
+		}
+		if !duplicate {
+			protocols = append(protocols, protocol)
+		}
 	}
+	return protocols, nil
+}
 
-	isSupported := false
-	for _, m := range supportedHashFunctions {
-		if m == mode {
-			isSupported = true
-			break
+// allowMethods responds 405 Method Not Allowed to the requests with other methods
+func allowMethods(handler http.HandlerFunc, methods ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		for _, method := range methods {
+			if r.Method == method {
+				handler(w, r)
+				return
+			}
 		}
+		w.Header().Set("Allow", strings.Join(methods, ", "))
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
 	}
+}
 
+func initServerCmd() {
+	serverCmd.Flags().IntP("port", "p", 8080, "Port to run the server on")
+	serverCmd.Flags().StringP("mode", "m", protocolHash, "Comma-separated password checking modes (protocols) to serve: \"hash\", \"psi\", e.g. \"hash,psi\"")
+	serverCmd.Flags().Duration("read-timeout", 10*time.Second, "Maximum duration for reading a request, including the body")
+	serverCmd.Flags().Duration("write-timeout", time.Minute, "Maximum duration for writing a response")
+	serverCmd.Flags().Duration("idle-timeout", 2*time.Minute, "Maximum duration a keep-alive connection waits for the next request")
+	serverCmd.Flags().Duration("shutdown-timeout", 30*time.Second, "Maximum duration to drain the in-flight requests on SIGINT or SIGTERM")
+	serverCmd.Flags().Bool("watch-state", true, "Reload the dataset when state.json or exclusions.json changes")
+	serverCmd.Flags().String("admin-address", "", "Address of the admin endpoints (POST /admin/reload), e.g. \"127.0.0.1:8081\"; disabled by default")
+	serverCmd.Flags().Bool("require-signed", false, "Refuse to start or to serve a generation whose manifest signatures do not verify, and the ranges not matching the signed manifest")
+	serverCmd.Flags().String("public-key", "", "Ed25519 public key file (PEM, PKIX) verifying the manifest signatures")
+	serverCmd.Flags().String("tls-cert", "", "TLS certificate file (PEM) to serve HTTPS with, reloaded when it changes")
+	serverCmd.Flags().String("tls-key", "", "TLS private key file (PEM) of the certificate, reloaded when it changes")
+	serverCmd.Flags().String("tls-client-ca", "", "CA certificates file (PEM) verifying the client certificates")
+	serverCmd.Flags().Bool("require-api-key", false, "Serve the requests only with an API key (see \"apikey create\") in the \"hibp-api-key\" header")
+	serverCmd.Flags().String("require-client-cert", "", "Comma-separated endpoints requiring a verified client certificate: \"range\", \"pwnedpassword\", \"psi\", \"admin\" or \"all\"")
+}
+
+func handleRange(w http.ResponseWriter, r *http.Request) {
+	prefix := strings.ToUpper(strings.TrimPrefix(r.URL.Path, "/range/"))
+	mode := getRequestMode(r)
+
+	// Check if the requested mode is supported
+	dataset := served.acquire()
+	defer dataset.release()
+	storage, isSupported := dataset.storage(mode)
 	if !isSupported {
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte(fmt.Sprintf("Requested hash function '%s' is not supported", mode)))
 		return
 	}
 
-	folderPath := mode
-
-	// Construct the filename based on the given prefix
-	filename := filepath.Join(getStoragePath(), folderPath, prefix+".txt")
-
-	// Check if the file exists
-	_, err = os.Stat(filename)
-	if os.IsNotExist(err) {
-		// If the file doesn't exist, set the response code to 400 and write the error message to the response body
+	// Validate the prefix format
+	if _, err := parsePrefix(prefix); err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte("The hash prefix was not in a valid format"))
 		return
 	}
 
-	// Open the file
-	file, err := os.Open(filename)
-	if err != nil {
-		// If there is an error opening the file, handle it (you may choose to log the error or handle it differently)
+	// Caching
+	metadata, err := storage.Metadata(prefix)
+	if err == errPrefixNotFound {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("The hash prefix was not in a valid format"))
+		return
+	} else if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte("Internal Server Error"))
 		return
 	}
-	defer file.Close()
+	if isNotModified(r, metadata.LastModified, metadata.ETag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
 
-	// Get file information
-	fileInfo, err := file.Stat()
+	records, err := storage.GetRange(prefix)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte("Internal Server Error"))
 		return
 	}
 
-	// Caching
+	// Set Last-Modified header using the range modification date, if it exists
+	if !metadata.LastModified.IsZero() {
+		w.Header().Set("Last-Modified", metadata.LastModified.UTC().Format(http.TimeFormat))
+	}
+
+	// Set ETag header, if the ETag exists
+	if metadata.ETag != "" {
+		w.Header().Set("ETag", metadata.ETag)
+	}
+
+	// Handle Add-Padding header
+	if r.Header.Get("Add-Padding") == "true" {
+		records = append(records, generatePaddingRecords(mode, len(records))...)
+	}
+
+	// Set the response code to 200
+	w.WriteHeader(http.StatusOK)
+
+	// Write the response content to the response body
+	w.Write([]byte(formatRange(records)))
+}
+
+// isNotModified checks the conditional request headers against the range modification time and ETag
+func isNotModified(r *http.Request, modTime time.Time, etag string) bool {
 	modified := true
 	ifModifiedSince := r.Header.Get("If-Modified-Since")
 	ifNoneMatch := r.Header.Get("If-None-Match")
-	etag, err := xattr.Get(filename, "user.etag")
-	if (ifModifiedSince != "" && !fileInfo.ModTime().IsZero()) || (err == nil && ifNoneMatch != "") {
+	if (ifModifiedSince != "" && !modTime.IsZero()) || (etag != "" && ifNoneMatch != "") {
 		modified = false
 	}
 
-	if ifModifiedSince != "" && !fileInfo.ModTime().IsZero() && fileInfo.ModTime().After(parseTime(ifModifiedSince)) {
+	if ifModifiedSince != "" && !modTime.IsZero() && modTime.After(parseTime(ifModifiedSince)) {
 		modified = true
 	}
-	if err == nil && ifNoneMatch != "" && ifNoneMatch != string(etag) {
+	if etag != "" && ifNoneMatch != "" && ifNoneMatch != etag {
 		modified = true
 	}
-	if !modified {
-		w.WriteHeader(http.StatusNotModified)
-		return
-	}
-
-	// Set Last-Modified header using the file's modification date, if it exists
-	if !fileInfo.ModTime().IsZero() {
-		w.Header().Set("Last-Modified", fileInfo.ModTime().UTC().Format(http.TimeFormat))
-	}
+	return !modified
+}
 
-	// Set ETag header, if the ETag exists
-	if err == nil {
-		w.Header().Set("ETag", string(etag))
+// generatePaddingRecords returns the dummy records padding a range of recordsCount records, if necessary
+func generatePaddingRecords(mode string, recordsCount int) []HashRecord {
+	if recordsCount >= 1300 {
+		return nil
 	}
-
-	// Handle Add-Padding header
-	addPadding := r.Header.Get("Add-Padding") == "true"
-	var responseContent string
-
-	if !addPadding {
-		fileSize := fileInfo.Size()
-		fileContent := make([]byte, fileSize)
-		_, err = file.Read(fileContent)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte("Internal Server Error"))
-			return
-		}
-		responseContent = string(fileContent)
-	} else {
-		scanner := bufio.NewScanner(file)
-		lineCount := 0
-		for scanner.Scan() {
-			lineCount++
-		}
-		if err := scanner.Err(); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte("Internal Server Error"))
-			return
-		}
-
-		// Generate dummy lines if necessary
-		if lineCount < 1300 {
-			numDummyLines := 1300 + rand.Intn(201) - lineCount
-			dummyLines := make([]string, numDummyLines)
-			for i := 0; i < numDummyLines; i++ {
-				var dummySuffix string
-				if mode == "ntlm" {
-					dummySuffix = fmt.Sprintf("%027d", 0)
-				} else {
-					dummySuffix = fmt.Sprintf("%035d", 0)
-				}
-				dummyLines[i] = dummySuffix + ":0"
-			}
-
-			// Read the file content again and append dummy lines
-			file.Seek(0, 0)
-			fileContent, err := io.ReadAll(file)
-			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				w.Write([]byte("Internal Server Error"))
-				return
-			}
-			responseContent = string(fileContent) + "\n" + strings.Join(dummyLines, "\n")
-		} else {
-			// Read the file content directly if no padding is needed
-			file.Seek(0, 0)
-			fileContent, err := io.ReadAll(file)
-			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				w.Write([]byte("Internal Server Error"))
-				return
-			}
-			responseContent = string(fileContent)
-		}
+	numDummyRecords := 1300 + rand.Intn(201) - recordsCount
+	dummyRecords := make([]HashRecord, numDummyRecords)
+	dummySuffix := strings.Repeat("0", getSuffixLength(mode))
+	for i := 0; i < numDummyRecords; i++ {
+		dummyRecords[i] = HashRecord{Suffix: dummySuffix, Count: 0}
 	}
-
-	// Set the response code to 200
-	w.WriteHeader(http.StatusOK)
-
-	// Write the response content to the response body
-	w.Write([]byte(responseContent))
+	return dummyRecords
 }
 
 func parseTime(value string) time.Time {
@@ -232,27 +399,12 @@ func parseTime(value string) time.Time {
 }
 
 func handlePwnedPassword(w http.ResponseWriter, r *http.Request) {
-	mode := r.URL.Query().Get("mode")
-	if mode != "ntlm" {
-		mode = "sha1"
-	}
+	mode := getRequestMode(r)
 
 	// Check if the requested mode is supported
-	supportedHashFunctions, err := getSupportedHashFunctions()
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("Error checking supported hash functions"))
-		return
-	}
-
-	isSupported := false
-	for _, m := range supportedHashFunctions {
-		if m == mode {
-			isSupported = true
-			break
-		}
-	}
-
+	dataset := served.acquire()
+	defer dataset.release()
+	storage, isSupported := dataset.storage(mode)
 	if !isSupported {
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte(fmt.Sprintf("Requested hash function '%s' is not supported", mode)))
@@ -263,7 +415,7 @@ func handlePwnedPassword(w http.ResponseWriter, r *http.Request) {
 	hashValue := strings.ToUpper(strings.TrimPrefix(r.URL.Path, "/pwnedpassword/"))
 
 	// Validate the hash format
-	if (mode == "sha1" && len(hashValue) != 40) || (mode == "ntlm" && len(hashValue) != 32) {
+	if len(hashValue) != getDigestLength(mode) {
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte("The hash was not in a valid format"))
 		return
@@ -272,50 +424,18 @@ func handlePwnedPassword(w http.ResponseWriter, r *http.Request) {
 	// Extract prefix and suffix
 	prefix := hashValue[:5]
 	suffix := hashValue[5:]
-
-	// Construct the filename based on the given prefix
-	filename := filepath.Join(getStoragePath(), mode, prefix+".txt")
-
-	// Check if the file exists
-	_, err = os.Stat(filename)
-	if os.IsNotExist(err) {
-		w.WriteHeader(http.StatusNotFound)
+	if _, err := parsePrefix(prefix); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("The hash was not in a valid format"))
 		return
 	}
 
-	// Open the file
-	file, err := os.Open(filename)
+	count, err := storage.LookupSuffix(prefix, suffix)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte("Internal Server Error"))
 		return
 	}
-	defer file.Close()
-
-	// Read the file line by line and check for the suffix
-	var count int
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := scanner.Text()
-		if strings.HasPrefix(line, suffix) {
-			parts := strings.Split(line, ":")
-			if len(parts) == 2 {
-				count, err = strconv.Atoi(parts[1])
-				if err != nil {
-					w.WriteHeader(http.StatusInternalServerError)
-					w.Write([]byte("Internal Server Error"))
-					return
-				}
-				break
-			}
-		}
-	}
-
-	if err := scanner.Err(); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("Internal Server Error"))
-		return
-	}
 
 	if count == 0 {
 		w.WriteHeader(http.StatusNotFound)
@@ -327,43 +447,17 @@ func handlePwnedPassword(w http.ResponseWriter, r *http.Request) {
 
 func handlePSI(w http.ResponseWriter, r *http.Request) {
 	prefix := strings.ToUpper(strings.TrimPrefix(r.URL.Path, "/psi/"))
-	mode := r.URL.Query().Get("mode")
-	if mode != "ntlm" {
-		mode = "sha1"
-	}
+	mode := getRequestMode(r)
 
 	// Check if the requested mode is supported
-	supportedHashFunctions, err := getSupportedHashFunctions()
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("Error checking supported hash functions"))
-		return
-	}
-
-	isSupported := false
-	for _, m := range supportedHashFunctions {
-		if m == mode {
-			isSupported = true
-			break
-		}
-	}
-
+	dataset := served.acquire()
+	defer dataset.release()
+	storage, isSupported := dataset.storage(mode)
 	if !isSupported {
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte(fmt.Sprintf("Requested hash function '%s' is not supported", mode)))
 		return
 	}
-	folderPath := mode
-
-	// Determine the storage subdirectory based on the mode parameter
-	if mode == "ntlm" {
-		folderPath = "ntlm"
-	} else {
-		folderPath = "sha1"
-	}
-
-	// Construct the filename based on the given prefix
-	filename := filepath.Join(getStoragePath(), folderPath, prefix+".txt")
 
 	// Read the request body
 	requestBody, err := io.ReadAll(r.Body)
@@ -379,46 +473,25 @@ func handlePSI(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Check if the file exists
-	_, err = os.Stat(filename)
-	if os.IsNotExist(err) {
+	// Validate the prefix format
+	if _, err := parsePrefix(prefix); err != nil {
 		http.Error(w, "The hash prefix was not in a valid format", http.StatusBadRequest)
 		return
 	}
 
-	// Open the file
-	file, err := os.Open(filename)
-	if err != nil {
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	records, err := storage.GetRange(prefix)
+	if err == errPrefixNotFound {
+		http.Error(w, "The hash prefix was not in a valid format", http.StatusBadRequest)
 		return
-	}
-	defer file.Close()
-
-	// Get file information
-	fileInfo, err := file.Stat()
-	if err != nil {
+	} else if err != nil {
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
 
-	fileSize := fileInfo.Size()
-	fileContent := make([]byte, fileSize)
-	_, err = file.Read(fileContent)
-	if err != nil {
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		return
-	}
-
-	// Split file content into lines
-	lines := strings.Split(string(fileContent), "\n")
-
-	// Extract values from lines
-	var values []string
-	for _, line := range lines {
-		parts := strings.Split(line, ":")
-		if len(parts) == 2 {
-			values = append(values, strings.TrimSpace(parts[0]))
-		}
+	// Extract values from records
+	values := make([]string, 0, len(records))
+	for _, record := range records {
+		values = append(values, record.Suffix)
 	}
 
 	server, err := psi_server.CreateWithNewKey(true)
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// The manifest of a hash function is signed with an Ed25519 key, the base64 signature is kept in
+// <data>/<folder>.manifest.sig. The keys are PEM files: PKCS #8 private keys and PKIX public keys,
+// e.g. generated with "openssl genpkey -algorithm ed25519".
+
+var signCmd = &cobra.Command{
+	Use:   "sign",
+	Short: "Sign the checksum manifests of the storage",
+	Long:  `Sign the checksum manifests of all hash functions of the current (or a given) generation with an Ed25519 private key.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		lock, err := lockStorage(cmd)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		defer lock.unlock()
+		keyPath, _ := cmd.Flags().GetString("key")
+		generation, _ := cmd.Flags().GetString("generation")
+		key, err := loadSigningKey(keyPath)
+		if err != nil {
+			fmt.Printf("Error loading signing key: %v\n", err)
+			os.Exit(1)
+		}
+		dataPath, hashFunctions, err := getSignedGeneration(generation)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		if err := signManifests(dataPath, hashFunctions, key); err != nil {
+			fmt.Printf("Error signing manifests: %v\n", err)
+			os.Exit(1)
+		}
+		if !quietFlag {
+			fmt.Printf("Signed the manifests of %v\n", hashFunctions)
+		}
+	},
+}
+
+var verifySignatureCmd = &cobra.Command{
+	Use:   "verify-signature",
+	Short: "Verify the signed checksum manifests and the storage against them",
+	Long:  `Verify the manifest signatures of all hash functions of the current (or a given) generation with an Ed25519 public key, then verify the stored values against the manifests.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		publicKeyPath, _ := cmd.Flags().GetString("public-key")
+		generation, _ := cmd.Flags().GetString("generation")
+		publicKey, err := loadPublicKey(publicKeyPath)
+		if err != nil {
+			fmt.Printf("Error loading public key: %v\n", err)
+			os.Exit(1)
+		}
+		dataPath, hashFunctions, err := getSignedGeneration(generation)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		if err := verifyManifestSignatures(dataPath, hashFunctions, publicKey); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		healthy := true
+		for _, mode := range hashFunctions {
+			if !quietFlag {
+				fmt.Printf("Verifying %s storage against the signed manifest...\n", mode)
+			}
+			bad, err := verifyStorage(dataPath, mode)
+			if err != nil {
+				fmt.Printf("Error verifying %s storage: %v\n", mode, err)
+				healthy = false
+			} else if len(bad) > 0 {
+				printBadPrefixes(mode, bad)
+				healthy = false
+			}
+		}
+		if !healthy {
+			os.Exit(1)
+		}
+		if !quietFlag {
+			fmt.Printf("The signatures and the values of %v are valid\n", hashFunctions)
+		}
+	},
+}
+
+func initSignCmds() {
+	signCmd.Flags().String("key", "", "Ed25519 private key file (PEM, PKCS #8)")
+	signCmd.MarkFlagRequired("key")
+	signCmd.Flags().String("generation", "", "Generation to sign (by default the current one)")
+	verifySignatureCmd.Flags().String("public-key", "", "Ed25519 public key file (PEM, PKIX)")
+	verifySignatureCmd.MarkFlagRequired("public-key")
+	verifySignatureCmd.Flags().String("generation", "", "Generation to verify (by default the current one)")
+}
+
+func getManifestSignaturePath(dataPath, mode string) string {
+	return getManifestPath(dataPath, mode) + ".sig"
+}
+
+// getSignedGeneration returns the data directory and the hash functions of the generation, the current one if id is empty
+func getSignedGeneration(id string) (string, []string, error) {
+	state, err := readStateFile()
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to read state file: %v", err)
+	}
+	if id == "" {
+		return getDataPath(), state.SupportedHashFunctions, nil
+	}
+	for _, generation := range state.Generations {
+		if generation.ID == id {
+			return getGenerationPath(id), generation.HashFunctions, nil
+		}
+	}
+	return "", nil, fmt.Errorf("unknown generation: %s", id)
+}
+
+func loadSigningKey(path string) (ed25519.PrivateKey, error) {
+	block, err := readPEMFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %v", err)
+	}
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("the private key is not an Ed25519 key")
+	}
+	return privateKey, nil
+}
+
+func loadPublicKey(path string) (ed25519.PublicKey, error) {
+	block, err := readPEMFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key: %v", err)
+	}
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("the public key is not an Ed25519 key")
+	}
+	return publicKey, nil
+}
+
+func readPEMFile(path string) (*pem.Block, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s is not a PEM file", path)
+	}
+	return block, nil
+}
+
+// manifestSignedMessage binds the manifest to its hash function, so manifests cannot be swapped
+func manifestSignedMessage(mode string, manifest []byte) []byte {
+	return append([]byte("pccserver manifest "+mode+"\n"), manifest...)
+}
+
+// signManifests writes the signatures of the manifests of the hash functions in the data directory
+func signManifests(dataPath string, hashFunctions []string, key ed25519.PrivateKey) error {
+	for _, mode := range hashFunctions {
+		manifest, err := os.ReadFile(getManifestPath(dataPath, mode))
+		if err != nil {
+			return fmt.Errorf("failed to read %s manifest: %v", mode, err)
+		}
+		signature := ed25519.Sign(key, manifestSignedMessage(mode, manifest))
+
+		// The previous signature may be hard-linked from other generations, so it is replaced by a rename
+		path := getManifestSignaturePath(dataPath, mode)
+		tmpPath := path + ".tmp"
+		if err := os.WriteFile(tmpPath, []byte(base64.StdEncoding.EncodeToString(signature)+"\n"), 0644); err != nil {
+			return fmt.Errorf("failed to write %s manifest signature: %v", mode, err)
+		}
+		if err := os.Rename(tmpPath, path); err != nil {
+			os.Remove(tmpPath)
+			return fmt.Errorf("failed to write %s manifest signature: %v", mode, err)
+		}
+	}
+	return nil
+}
+
+// verifyManifestSignatures checks the signatures of the manifests of the hash functions in the data directory
+func verifyManifestSignatures(dataPath string, hashFunctions []string, publicKey ed25519.PublicKey) error {
+	if len(hashFunctions) == 0 {
+		return fmt.Errorf("there are no hash functions to verify")
+	}
+	for _, mode := range hashFunctions {
+		if _, err := readSignedManifest(dataPath, mode, publicKey); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readSignedManifest returns the manifest of the hash function if its signature verifies
+func readSignedManifest(dataPath, mode string, publicKey ed25519.PublicKey) ([]byte, error) {
+	manifest, err := os.ReadFile(getManifestPath(dataPath, mode))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s manifest: %v", mode, err)
+	}
+	encoded, err := os.ReadFile(getManifestSignaturePath(dataPath, mode))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s manifest signature: %v", mode, err)
+	}
+	signature, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+	if err != nil {
+		return nil, fmt.Errorf("malformed %s manifest signature: %v", mode, err)
+	}
+	if !ed25519.Verify(publicKey, manifestSignedMessage(mode, manifest), signature) {
+		return nil, fmt.Errorf("the %s manifest signature does not verify", mode)
+	}
+	return manifest, nil
+}
+
+// signedStorage serves the ranges only if they match the checksums of the signed manifest,
+// so the values altered after signing are not served
+type signedStorage struct {
+	Storage
+	mode         string
+	suffixLength int
+	// SHA-256 checksums of the prefixes by prefix value, and whether the manifest lists the prefix
+	checksums []byte
+	listed    []bool
+}
+
+// withSignedManifest wraps the storage of the mode in the data directory if its manifest signature verifies
+func withSignedManifest(storage Storage, dataPath, mode string, publicKey ed25519.PublicKey) (Storage, error) {
+	manifest, err := readSignedManifest(dataPath, mode, publicKey)
+	if err != nil {
+		return nil, err
+	}
+	signed := &signedStorage{
+		Storage:      storage,
+		mode:         mode,
+		suffixLength: getSuffixLength(mode),
+		checksums:    make([]byte, HIBPPrefixesCount*sha256.Size),
+		listed:       make([]bool, HIBPPrefixesCount),
+	}
+	for _, line := range strings.Split(string(manifest), "\n") {
+		if line == "" {
+			continue
+		}
+		prefix, checksum, _ := strings.Cut(line, " ")
+		prefixValue, err := parsePrefix(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("malformed %s manifest line: %q", mode, line)
+		}
+		offset := prefixValue * sha256.Size
+		if n, err := hex.Decode(signed.checksums[offset:offset+sha256.Size], []byte(checksum)); err != nil || n != sha256.Size {
+			return nil, fmt.Errorf("malformed %s manifest line: %q", mode, line)
+		}
+		signed.listed[prefixValue] = true
+	}
+	return signed, nil
+}
+
+// verifiedRange returns the raw range of the prefix if it matches the signed manifest
+func (storage *signedStorage) verifiedRange(prefix string) ([]byte, error) {
+	prefixValue, err := parsePrefix(prefix)
+	if err != nil {
+		return nil, errPrefixNotFound
+	}
+	data, err := readRawRange(storage.Storage, prefix)
+	if err != nil && !storage.listed[prefixValue] {
+		return nil, err
+	}
+	// A listed range which cannot be read, e.g. removed after signing, does not match the manifest either
+	offset := prefixValue * sha256.Size
+	checksum := sha256.Sum256(data)
+	if err != nil || !storage.listed[prefixValue] || !bytes.Equal(checksum[:], storage.checksums[offset:offset+sha256.Size]) {
+		log.Printf("The %s range %s does not match the signed manifest", storage.mode, prefix)
+		return nil, fmt.Errorf("the %s range %s does not match the signed manifest", storage.mode, prefix)
+	}
+	return data, nil
+}
+
+func (storage *signedStorage) GetRange(prefix string) ([]HashRecord, error) {
+	data, err := storage.verifiedRange(prefix)
+	if err != nil {
+		return nil, err
+	}
+	return parseValidatedRange(data, storage.suffixLength)
+}
+
+func (storage *signedStorage) LookupSuffix(prefix, suffix string) (uint64, error) {
+	records, err := storage.GetRange(prefix)
+	if err == errPrefixNotFound {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	for _, record := range records {
+		if record.Suffix == suffix {
+			return record.Count, nil
+		}
+	}
+	return 0, nil
+}
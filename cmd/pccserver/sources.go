@@ -0,0 +1,306 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// Named sources (<storage>/sources/<name>/<mode>) hold the values imported with "import-values --source".
+// They are not served directly: the "merge" command combines them into a new generation.
+const sourcesDirectory = "sources"
+
+// Rules combining the counts of a suffix listed by several sources
+const (
+	mergeRuleSum      = "sum"
+	mergeRuleMax      = "max"
+	mergeRulePriority = "priority"
+)
+
+var sourceNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// DataSource describes a named source recorded in the state file
+type DataSource struct {
+	Name          string    `json:"name"`
+	HashFunctions []string  `json:"hash_functions"`
+	UpdatedAt     time.Time `json:"updated_at"`
+	// Minimum counts of the records imported for the hash functions, absent if unfiltered
+	MinCounts map[string]uint64 `json:"min_counts,omitempty"`
+}
+
+// MergeSettings describes how the served data was combined from the sources
+type MergeSettings struct {
+	Sources       []string  `json:"sources"`
+	Rule          string    `json:"rule"`
+	HashFunctions []string  `json:"hash_functions"`
+	MergedAt      time.Time `json:"merged_at"`
+}
+
+var mergeCmd = &cobra.Command{
+	Use:   "merge",
+	Short: "Merge the named sources into the served storage",
+	Long:  `Combine the values of the named sources per prefix and switch the served storage to the result.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		lock, err := lockStorage(cmd)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		defer lock.unlock()
+		sourcesValue, _ := cmd.Flags().GetString("sources")
+		rule, _ := cmd.Flags().GetString("rule")
+		if rule != mergeRuleSum && rule != mergeRuleMax && rule != mergeRulePriority {
+			fmt.Printf("Error: incorrect \"rule\" parameter value. Allowed values: \"sum\", \"max\", \"priority\"\n")
+			return
+		}
+		hashFunction, _ := cmd.Flags().GetString("hash-function")
+		if hashFunction != "" {
+			if err := validateHashFunction(hashFunction); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+		}
+
+		state, err := readStateFile()
+		if err != nil {
+			fmt.Printf("Error reading state: %v\n", err)
+			return
+		}
+		var sources []string
+		if sourcesValue != "" {
+			sources = strings.Split(sourcesValue, ",")
+		} else {
+			for _, source := range state.Sources {
+				sources = append(sources, source.Name)
+			}
+		}
+		if len(sources) == 0 {
+			fmt.Println("Error: there are no sources to merge, import them with \"import-values --source\"")
+			return
+		}
+		if err := mergeSources(state, sources, rule, hashFunction); err != nil {
+			fmt.Printf("Error merging sources: %v\n", err)
+		}
+	},
+}
+
+func initMergeCmd() {
+	mergeCmd.Flags().String("sources", "", "Comma-separated sources to merge, in priority order (by default all sources)")
+	mergeCmd.Flags().String("rule", mergeRuleMax, "Rule combining the counts of a hash listed by several sources: \"sum\", \"max\" or \"priority\" (the count of the first source listing it)")
+	mergeCmd.Flags().String("hash-function", "", "Hash function to merge (by default all hash functions of the sources)")
+}
+
+func validateSourceName(name string) error {
+	if !sourceNamePattern.MatchString(name) {
+		return fmt.Errorf("incorrect source name %q: only letters, digits, \"-\" and \"_\" are allowed", name)
+	}
+	return nil
+}
+
+func getSourcePath(name string) string {
+	return filepath.Join(getStoragePath(), sourcesDirectory, name)
+}
+
+// recordSourceImport records the import of the hash functions into the source in the state file,
+// the given minimum counts replace the previous ones
+func recordSourceImport(name string, minCounts map[string]uint64, hashFunctions ...string) error {
+	state, err := readStateFile()
+	if err != nil {
+		return fmt.Errorf("failed to read state file: %v", err)
+	}
+	var source *DataSource
+	for i := range state.Sources {
+		if state.Sources[i].Name == name {
+			source = &state.Sources[i]
+		}
+	}
+	if source == nil {
+		state.Sources = append(state.Sources, DataSource{Name: name})
+		source = &state.Sources[len(state.Sources)-1]
+	}
+	for _, hashFunction := range hashFunctions {
+		found := false
+		for _, funcName := range source.HashFunctions {
+			if funcName == hashFunction {
+				found = true
+				break
+			}
+		}
+		if !found {
+			source.HashFunctions = append(source.HashFunctions, hashFunction)
+		}
+	}
+	sort.Strings(source.HashFunctions)
+	source.MinCounts = mergeMinCounts(source.MinCounts, minCounts)
+	source.UpdatedAt = time.Now().UTC()
+	sort.Slice(state.Sources, func(i, j int) bool {
+		return state.Sources[i].Name < state.Sources[j].Name
+	})
+	if state.PendingImport != nil && state.PendingImport.Source == name {
+		state.PendingImport = nil
+	}
+	return writeStateFile(state)
+}
+
+// mergeMinCounts returns the minimum counts with the updated ones replaced, dropping the zero (unfiltered) ones
+func mergeMinCounts(minCounts, updated map[string]uint64) map[string]uint64 {
+	merged := map[string]uint64{}
+	for hashFunction, minCount := range minCounts {
+		merged[hashFunction] = minCount
+	}
+	for hashFunction, minCount := range updated {
+		if minCount > 0 {
+			merged[hashFunction] = minCount
+		} else {
+			delete(merged, hashFunction)
+		}
+	}
+	if len(merged) == 0 {
+		return nil
+	}
+	return merged
+}
+
+// mergeSources writes the merged hash functions of the sources into a new generation and activates it.
+// The hash functions the sources do not have are kept from the current generation.
+func mergeSources(state *State, sources []string, rule, hashFunction string) error {
+	modeSources := map[string][]string{}
+	for _, name := range sources {
+		var source *DataSource
+		for i := range state.Sources {
+			if state.Sources[i].Name == name {
+				source = &state.Sources[i]
+			}
+		}
+		if source == nil {
+			return fmt.Errorf("unknown source: %s", name)
+		}
+		for _, mode := range source.HashFunctions {
+			if hashFunction == "" || mode == hashFunction {
+				modeSources[mode] = append(modeSources[mode], name)
+			}
+		}
+	}
+	if len(modeSources) == 0 {
+		return fmt.Errorf("the sources have no %s values", hashFunction)
+	}
+	modes := make([]string, 0, len(modeSources))
+	for mode := range modeSources {
+		modes = append(modes, mode)
+	}
+	sort.Strings(modes)
+	exclusions, err := readExclusions()
+	if err != nil {
+		return fmt.Errorf("failed to read exclusions: %v", err)
+	}
+
+	startedAt := time.Now().UTC()
+	generation, err := createGeneration()
+	if err != nil {
+		return fmt.Errorf("failed to create storage generation: %v", err)
+	}
+	for _, mode := range modes {
+		if !quietFlag {
+			fmt.Printf("Merging %s values of %s...\n", mode, strings.Join(modeSources[mode], ", "))
+		}
+		if err := mergeSourceStorages(getGenerationPath(generation), mode, modeSources[mode], rule, exclusions); err != nil {
+			discardGeneration(generation)
+			return fmt.Errorf("failed to merge %s values: %v", mode, err)
+		}
+	}
+
+	// The merged values are not filtered as a whole, the minimum counts of the sources are kept with them
+	datasets := map[string]Dataset{}
+	for _, mode := range modes {
+		datasets[mode] = Dataset{
+			Source:    fmt.Sprintf("merge of %s by %s", strings.Join(modeSources[mode], ", "), rule),
+			StartedAt: startedAt,
+		}
+	}
+	if err := activateGeneration(generation, datasets, nil); err != nil {
+		return fmt.Errorf("failed to activate storage generation: %v", err)
+	}
+	state, err = readStateFile()
+	if err != nil {
+		return fmt.Errorf("failed to read state file: %v", err)
+	}
+	state.Merge = &MergeSettings{
+		Sources:       sources,
+		Rule:          rule,
+		HashFunctions: modes,
+		MergedAt:      time.Now().UTC(),
+	}
+	return writeStateFile(state)
+}
+
+// mergeSourceStorages writes every prefix of the mode combined from the sources into the data directory
+func mergeSourceStorages(dataPath, mode string, sources []string, rule string, exclusions Exclusions) error {
+	storages := []Storage{}
+	for _, name := range sources {
+		storage, err := openStorage(getSourcePath(name), mode)
+		if err != nil {
+			return fmt.Errorf("failed to open source %s: %v", name, err)
+		}
+		defer storage.Close()
+		storages = append(storages, storage)
+	}
+	target := withExclusions(newWritableDirectoryStorage(dataPath, mode), exclusions, mode)
+
+	err := processPrefixes(nil, func(prefix string) error {
+		ranges := make([][]HashRecord, 0, len(storages))
+		for _, storage := range storages {
+			records, err := storage.GetRange(prefix)
+			if err != nil && err != errPrefixNotFound {
+				return err
+			}
+			ranges = append(ranges, records)
+		}
+		return target.PutRange(prefix, mergeRanges(ranges, rule), PrefixMetadata{LastModified: time.Now()})
+	})
+	if err != nil {
+		return err
+	}
+
+	// The merged prefix files supersede the packed file of the previous generation
+	if err := os.Remove(getPackedStoragePath(dataPath, mode)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// mergeRanges combines the ranges of the sources (in priority order) into one sorted range
+func mergeRanges(ranges [][]HashRecord, rule string) []HashRecord {
+	counts := map[string]uint64{}
+	for _, records := range ranges {
+		for _, record := range records {
+			count, found := counts[record.Suffix]
+			switch {
+			case !found:
+				counts[record.Suffix] = record.Count
+			case rule == mergeRuleSum:
+				// Saturate instead of wrapping around
+				if count+record.Count < count {
+					counts[record.Suffix] = ^uint64(0)
+				} else {
+					counts[record.Suffix] = count + record.Count
+				}
+			case rule == mergeRuleMax:
+				counts[record.Suffix] = max(count, record.Count)
+			}
+		}
+	}
+	merged := make([]HashRecord, 0, len(counts))
+	for suffix, count := range counts {
+		merged = append(merged, HashRecord{Suffix: suffix, Count: count})
+	}
+	sort.Slice(merged, func(i, j int) bool {
+		return merged[i].Suffix < merged[j].Suffix
+	})
+	return merged
+}
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 )
@@ -38,6 +40,33 @@ func outputState(jsonMode bool) {
 		fmt.Println(string(data))
 	} else {
 		fmt.Printf("Supported Hash Functions: %v\n", state.SupportedHashFunctions)
+		if state.CurrentGeneration != "" {
+			fmt.Printf("Current Generation: %s\n", state.CurrentGeneration)
+		}
+		for _, hashFunction := range state.SupportedHashFunctions {
+			if dataset, ok := state.Datasets[hashFunction]; ok {
+				printDataset(hashFunction, dataset)
+			}
+		}
+		for _, generation := range state.Generations {
+			fmt.Printf("Generation %s (created %s): %v\n", generation.ID, generation.CreatedAt.Format(time.RFC3339), generation.HashFunctions)
+		}
+		for _, source := range state.Sources {
+			fmt.Printf("Source %s (updated %s): %v", source.Name, source.UpdatedAt.Format(time.RFC3339), source.HashFunctions)
+			if len(source.MinCounts) > 0 {
+				fmt.Printf(", minimum counts %v", source.MinCounts)
+			}
+			fmt.Println()
+		}
+		if state.Merge != nil {
+			fmt.Printf("Merged %v of sources %v by %s (merged %s)\n", state.Merge.HashFunctions, state.Merge.Sources, state.Merge.Rule, state.Merge.MergedAt.Format(time.RFC3339))
+		}
+		for _, server := range state.Servers {
+			fmt.Printf("Server %s (PID %d on %s) on %s (started %s), protocols: %s, generations: %s\n", server.ID, server.PID, server.Host, server.Address, server.StartedAt.Format(time.RFC3339), strings.Join(server.Protocols, ", "), strings.Join(server.Generations, ", "))
+		}
+		if state.PendingImport != nil {
+			fmt.Printf("Interrupted import of %s (started %s), resume with \"import-values --resume\"\n", state.PendingImport.HashFunction, state.PendingImport.StartedAt.Format(time.RFC3339))
+		}
 	}
 }
 
@@ -46,11 +75,38 @@ func getState() (*State, error) {
 	if err != nil {
 		return nil, fmt.Errorf("Error retrieving state: %v", err)
 	}
+	state.Servers = listRunningServers()
 	return state, nil
 }
 
 type State struct {
-	SupportedHashFunctions []string `json:"supported_hash_functions"`
+	SupportedHashFunctions []string       `json:"supported_hash_functions"`
+	CurrentGeneration      string         `json:"current_generation,omitempty"`
+	Generations            []Generation   `json:"generations,omitempty"`
+	PendingImport          *PendingImport `json:"pending_import,omitempty"`
+	Sources                []DataSource   `json:"sources,omitempty"`
+	Merge                  *MergeSettings `json:"merge,omitempty"`
+	// Datasets of the current generation by hash function
+	Datasets map[string]Dataset `json:"datasets,omitempty"`
+	// Prefixes of the hashes removed from the exclusion list by hash function, downloaded again
+	// without the caching headers by the next API import into the served storage
+	RestoredPrefixes map[string][]string `json:"restored_prefixes,omitempty"`
+	// Servers running at the time of output-state, not kept in the state file
+	Servers []RunningServer `json:"servers,omitempty"`
+}
+
+// getMinCount returns the minimum count the records of the hash function were imported with
+// into the source, or into the served storage if source is empty
+func (state *State) getMinCount(hashFunction, source string) uint64 {
+	if source == "" {
+		return state.Datasets[hashFunction].MinCount
+	}
+	for _, dataSource := range state.Sources {
+		if dataSource.Name == source {
+			return dataSource.MinCounts[hashFunction]
+		}
+	}
+	return 0
 }
 
 func readStateFile() (*State, error) {
@@ -72,35 +128,35 @@ func readStateFile() (*State, error) {
 	return state, nil
 }
 
-func updateStateFile(newFunc string) error {
-	state, err := readStateFile()
-	if err != nil {
-		return fmt.Errorf("failed to read state file: %v", err)
-	}
-	found := false
-	for _, funcName := range state.SupportedHashFunctions {
-		if funcName == newFunc {
-			found = true
-			break
-		}
-	}
-	if !found {
-		state.SupportedHashFunctions = append(state.SupportedHashFunctions, newFunc)
+func writeStateFile(state *State) error {
+	if err := writeJSONFile(filepath.Join(getStoragePath(), "state.json"), state); err != nil {
+		return fmt.Errorf("failed to write state file: %v", err)
 	}
+	return nil
+}
 
-	path := filepath.Join(getStoragePath(), "state.json")
-	file, err := os.Create(path)
+// writeJSONFile atomically replaces the file with the indented JSON of the value: the readers see
+// either the previous or the new content, and a crash never leaves a truncated file
+func writeJSONFile(path string, value interface{}) error {
+	tmpPath := path + ".tmp"
+	file, err := os.Create(tmpPath)
 	if err != nil {
-		return fmt.Errorf("failed to create state file: %v", err)
+		return err
 	}
+	defer os.Remove(tmpPath)
 	defer file.Close()
 	encoder := json.NewEncoder(file)
 	encoder.SetIndent("", "  ")
-	err = encoder.Encode(state)
-	if err != nil {
-		return fmt.Errorf("failed to encode state: %v", err)
+	if err := encoder.Encode(value); err != nil {
+		return fmt.Errorf("failed to encode: %v", err)
 	}
-	return nil
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
 }
 
 func getSupportedHashFunctions() ([]string, error) {
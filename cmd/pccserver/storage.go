@@ -1,21 +1,23 @@
 package main
 
 import (
-	"bufio"
+	"crypto/ed25519"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
-	"path/filepath"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/pkg/xattr"
-
 	"github.com/avast/retry-go"
+	"github.com/petrkamnev/password-compromise-check-server/pkg/PasswordCompromiseCheckClientLib"
 	"github.com/schollz/progressbar/v3"
 	"github.com/spf13/cobra"
 )
@@ -25,73 +27,408 @@ var importCmd = &cobra.Command{
 	Short: "Import the values of compromised passwords",
 	Long:  `Import or update the password compromise checking server storage.`,
 	Run: func(cmd *cobra.Command, args []string) {
+		lock, err := lockStorage(cmd)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		defer lock.unlock()
+		source, _ := cmd.Flags().GetString("source")
+		if source != "" {
+			if err := validateSourceName(source); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+		}
+		var signingKey ed25519.PrivateKey
+		signKeyPath, _ := cmd.Flags().GetString("sign-key")
+		if signKeyPath != "" {
+			if source != "" {
+				fmt.Println("Error: the sources are not served, sign the merged storage instead")
+				return
+			}
+			var err error
+			signingKey, err = loadSigningKey(signKeyPath)
+			if err != nil {
+				fmt.Printf("Error loading signing key: %v\n", err)
+				return
+			}
+		}
+		wordlistPath, _ := cmd.Flags().GetString("wordlist")
+		if wordlistPath != "" {
+			wordlistCount, _ := cmd.Flags().GetUint64("wordlist-count")
+			importWordlist(wordlistPath, wordlistCount, source, signingKey)
+			return
+		}
 		hashFunction, _ := cmd.Flags().GetString("hash-function")
-		if hashFunction != "sha1" && hashFunction != "ntlm" {
-			fmt.Printf("Error: incorrect \"hash-function\" parameter value. Allowed values: \"sha1\", \"ntlm\"\n")
+		if err := validateHashFunction(hashFunction); err != nil {
+			fmt.Printf("Error: %v\n", err)
 			return
 		}
 		url, _ := cmd.Flags().GetString("url")
 		importFilePath, _ := cmd.Flags().GetString("file")
 		forceRewrite, _ := cmd.Flags().GetBool("force-rewrite")
-		//TODO: state checks (sha1, ntlm)
+		resume, _ := cmd.Flags().GetBool("resume")
+		inputOrder, _ := cmd.Flags().GetString("input-order")
+		if inputOrder != "hash" && inputOrder != "count" {
+			fmt.Printf("Error: incorrect \"input-order\" parameter value. Allowed values: \"hash\", \"count\"\n")
+			return
+		}
+		sortMemory, _ := cmd.Flags().GetInt("sort-memory")
+		tempDir, _ := cmd.Flags().GetString("temp-dir")
+		minCount, _ := cmd.Flags().GetUint64("min-count")
+		if minCount <= 1 {
+			// Every record has a count of at least 1
+			minCount = 0
+		}
+		startedAt := time.Now().UTC()
+
+		state, err := readStateFile()
+		if err != nil {
+			fmt.Printf("Error reading state: %v\n", err)
+			return
+		}
+		exclusions, err := readExclusions()
+		if err != nil {
+			fmt.Printf("Error reading exclusions: %v\n", err)
+			return
+		}
+
+		// Import into a new generation, which is switched to only when the import succeeds.
+		// Imports into a named source write into the source directory, which is served once merged.
+		var generation string
+		if resume {
+			if importFilePath != "" {
+				fmt.Println("Error: only API imports can be resumed")
+				return
+			}
+			if state.PendingImport == nil {
+				fmt.Println("Error: there is no interrupted import to resume")
+				return
+			}
+			generation = state.PendingImport.Generation
+			source = state.PendingImport.Source
+			hashFunction = state.PendingImport.HashFunction
+			url = state.PendingImport.URL
+			minCount = state.PendingImport.MinCount
+			startedAt = state.PendingImport.StartedAt
+		} else {
+			if state.PendingImport != nil {
+				// A new import supersedes the interrupted one
+				discardPendingImport(state.PendingImport)
+				if err := setPendingImport(nil); err != nil {
+					fmt.Printf("Error updating state: %v\n", err)
+					return
+				}
+			}
+			if source == "" {
+				generation, err = createGeneration()
+				if err != nil {
+					fmt.Printf("Error creating storage generation: %v\n", err)
+					return
+				}
+			}
+			// The imported text prefix files supersede the packed file of the previous generation
+			os.Remove(getPackedStoragePath(getImportDataPath(generation, source), hashFunction))
+			// The unchanged prefixes are filtered by the previous threshold, so they are downloaded again
+			if minCount != state.getMinCount(hashFunction, source) && !forceRewrite {
+				if !quietFlag {
+					fmt.Println("The minimum count has changed, all prefixes are downloaded again")
+				}
+				forceRewrite = true
+			}
+		}
+		dataPath := getImportDataPath(generation, source)
+		storage := withExclusions(newWritableDirectoryStorage(dataPath, hashFunction), exclusions, hashFunction)
+		if minCount > 0 {
+			storage = &minCountStorage{Storage: storage, minCount: minCount}
+		}
+
 		if *&importFilePath == "" {
+			if !resume {
+				err := setPendingImport(&PendingImport{
+					Generation:   generation,
+					Source:       source,
+					HashFunction: hashFunction,
+					URL:          url,
+					MinCount:     minCount,
+					StartedAt:    startedAt,
+				})
+				if err != nil {
+					fmt.Printf("Error updating state: %v\n", err)
+					if source == "" {
+						discardGeneration(generation)
+					}
+					return
+				}
+			}
+			journal, completed, failed, err := openImportJournal(dataPath)
+			if err != nil {
+				fmt.Printf("Error opening import journal: %v\n", err)
+				return
+			}
+			if resume && !quietFlag {
+				fmt.Printf("Resuming import of %s: %d prefixes completed, %d failed previously\n", hashFunction, len(completed), len(failed))
+			}
 			var cpd CompromisedPasswordsAPIImporter
 			cpd.url = url
 			cpd.client = &http.Client{}
 			cpd.mode = hashFunction
 			cpd.forceRewrite = forceRewrite
-			err := cpd.downloadAllPrefixes()
+			// The ranges filtered by the exclusions removed since are downloaded again
+			if source == "" && !forceRewrite && len(state.RestoredPrefixes[hashFunction]) > 0 {
+				cpd.rewritePrefixes = map[string]bool{}
+				for _, prefix := range state.RestoredPrefixes[hashFunction] {
+					cpd.rewritePrefixes[prefix] = true
+				}
+				if !quietFlag {
+					fmt.Printf("%d prefixes of removed exclusions are downloaded again\n", len(cpd.rewritePrefixes))
+				}
+			}
+			cpd.storage = storage
+			cpd.journal = journal
+			cpd.completed = completed
+			cpd.concurrency, _ = cmd.Flags().GetInt("concurrency")
+			err = cpd.downloadAllPrefixes()
+			journal.Close()
 			if err != nil {
+				// The imported prefixes and the journal are kept for "import-values --resume"
 				fmt.Printf("Error downloading prefixes: %v\n", err)
-			} else {
-				updateStateFile(hashFunction)
+				fmt.Println("Run \"import-values --resume\" to retry the failed prefixes")
+				return
 			}
+			removeImportJournal(dataPath)
 		} else {
 			var cpi CompromisedPasswordsFileImporter
 			cpi.filename = importFilePath
 			cpi.mode = hashFunction
-			err := cpi.importAllPrefixes()
+			cpi.storage = storage
+			cpi.inputOrder = inputOrder
+			cpi.sortMemory = sortMemory
+			cpi.tempDir = tempDir
+			err = cpi.importAllPrefixes()
 			if err != nil {
 				fmt.Printf("Error downloading prefixes: %v\n", err)
-			} else {
-				updateStateFile(hashFunction)
+				if source == "" {
+					discardGeneration(generation)
+				} else {
+					fmt.Printf("The source %s is partially updated, repeat the import before merging it\n", source)
+				}
+				return
+			}
+		}
+		if source != "" {
+			if err := recordSourceImport(source, map[string]uint64{hashFunction: minCount}, hashFunction); err != nil {
+				fmt.Printf("Error updating state: %v\n", err)
+			}
+			return
+		}
+		dataset := Dataset{
+			Source:    url,
+			StartedAt: startedAt,
+			MinCount:  minCount,
+		}
+		if importFilePath != "" {
+			dataset.Source = importFilePath
+			if importFilePath == "-" {
+				dataset.Source = "standard input"
 			}
 		}
+		if err := activateGeneration(generation, map[string]Dataset{hashFunction: dataset}, signingKey); err != nil {
+			fmt.Printf("Error activating storage generation: %v\n", err)
+			return
+		}
+		// Every prefix has been downloaded again or read from the file
+		if err := updateRestoredPrefixes(hashFunction, nil); err != nil {
+			fmt.Printf("Error updating state: %v\n", err)
+		}
 	},
 }
 
 func initImportCmd() {
-	importCmd.Flags().String("hash-function", "sha1", "Hash function for password checking: \"sha1\", \"ntlm\"")
+	importCmd.Flags().String("hash-function", PasswordCompromiseCheckClientLib.DefaultHashFunction, "Hash function for password checking: "+hashFunctionsList())
 	importCmd.Flags().StringP("url", "u", "https://api.pwnedpasswords.com/range/", "External password compromise checking API URL for import")
-	importCmd.Flags().StringP("file", "f", "", "File with compromised password hashes for import. If this parameter is given, the \"url\" parameter is ignored")
+	importCmd.Flags().StringP("file", "f", "", "File with compromised password hashes for import: plain text, gzip or zstd, \"-\" for the standard input. If this parameter is given, the \"url\" parameter is ignored")
 	importCmd.Flags().Bool("force-rewrite", false, "Do not use caching headers for storage update optimization")
+	importCmd.Flags().String("input-order", "hash", "Order of the records in the import file: \"hash\" (sorted by hash) or \"count\" (sorted by prevalence, requires an external sort)")
+	importCmd.Flags().Int("sort-memory", 5000000, "Maximum number of records kept in memory while sorting the import file")
+	importCmd.Flags().String("temp-dir", "", "Directory for temporary files of the import file sort (by default the system temporary directory)")
+	importCmd.Flags().Uint64("min-count", 0, "Drop the records seen less than the given number of times")
+	importCmd.Flags().Bool("resume", false, "Resume the interrupted or partially failed API import, retrying only the missing prefixes")
+	importCmd.Flags().String("wordlist", "", "Plaintext password list (one per line) to hash and merge into the storages of all hash functions: plain text, gzip or zstd, \"-\" for the standard input. If this parameter is given, the \"url\" and \"file\" parameters are ignored")
+	importCmd.Flags().Uint64("wordlist-count", 1, "Count assigned to the wordlist passwords")
+	importCmd.Flags().String("source", "", "Named source to import into instead of the served storage, the sources are combined by the \"merge\" command")
+	importCmd.Flags().Int("concurrency", 0, "Number of concurrent API requests (by default 8 per CPU, at most 64)")
+	importCmd.Flags().String("sign-key", "", "Ed25519 private key file (PEM, PKCS #8) to sign the checksum manifests of the imported generation with")
+}
+
+// importWordlist merges the hashed wordlist into a new generation of the current data or into the source
+func importWordlist(wordlistPath string, count uint64, source string, signingKey ed25519.PrivateKey) {
+	if count == 0 {
+		fmt.Println("Error: \"wordlist-count\" must be positive")
+		return
+	}
+	state, err := readStateFile()
+	if err != nil {
+		fmt.Printf("Error reading state: %v\n", err)
+		return
+	}
+	if state.PendingImport != nil {
+		fmt.Println("Error: an interrupted import is pending, finish it with \"import-values --resume\" first")
+		return
+	}
+	hashFunctions := []string{}
+	for _, hashFunction := range PasswordCompromiseCheckClientLib.HashFunctions() {
+		hashFunctions = append(hashFunctions, hashFunction.Name)
+	}
+	sort.Strings(hashFunctions)
+
+	var cwi CompromisedPasswordsWordlistImporter
+	cwi.filename = wordlistPath
+	cwi.count = count
+	if source != "" {
+		cwi.dataPath = getSourcePath(source)
+		cwi.sparse = true
+		if err := cwi.importWordlist(); err != nil {
+			fmt.Printf("Error importing wordlist: %v\n", err)
+			return
+		}
+		if err := recordSourceImport(source, nil, hashFunctions...); err != nil {
+			fmt.Printf("Error updating state: %v\n", err)
+		}
+		return
+	}
+
+	generation, err := createGeneration()
+	if err != nil {
+		fmt.Printf("Error creating storage generation: %v\n", err)
+		return
+	}
+	startedAt := time.Now().UTC()
+	cwi.dataPath = getGenerationPath(generation)
+	if err := cwi.importWordlist(); err != nil {
+		fmt.Printf("Error importing wordlist: %v\n", err)
+		discardGeneration(generation)
+		return
+	}
+	// The wordlist is merged into the current values, which keep their source and filter
+	datasets := map[string]Dataset{}
+	for _, hashFunction := range hashFunctions {
+		dataset := Dataset{
+			Source:    "wordlist " + wordlistPath,
+			StartedAt: startedAt,
+		}
+		if current, ok := state.Datasets[hashFunction]; ok {
+			dataset.Source = current.Source + ", " + dataset.Source
+			dataset.MinCount = current.MinCount
+		}
+		datasets[hashFunction] = dataset
+	}
+	if err := activateGeneration(generation, datasets, signingKey); err != nil {
+		fmt.Printf("Error activating storage generation: %v\n", err)
+	}
 }
 
 const HIBPPrefixesCount = 1 << 20
 
+// minCountStorage drops the records with counts below the minimum when writing
+type minCountStorage struct {
+	Storage
+	minCount uint64
+}
+
+func (storage *minCountStorage) PutRange(prefix string, records []HashRecord, metadata PrefixMetadata) error {
+	filtered := make([]HashRecord, 0, len(records))
+	for _, record := range records {
+		if record.Count >= storage.minCount {
+			filtered = append(filtered, record)
+		}
+	}
+	return storage.Storage.PutRange(prefix, filtered, metadata)
+}
+
+// processPrefixes concurrently calls process for the selected prefixes (all if selected is nil),
+// showing the progress. The first error stops the processing.
+func processPrefixes(selected func(prefix string) bool, process func(prefix string) error) error {
+	prefixes := []string{}
+	for prefix := 0; prefix < HIBPPrefixesCount; prefix++ {
+		prefixHex := fmt.Sprintf("%05X", prefix)
+		if selected == nil || selected(prefixHex) {
+			prefixes = append(prefixes, prefixHex)
+		}
+	}
+
+	var bar *progressbar.ProgressBar
+	if !quietFlag {
+		bar = progressbar.Default(int64(len(prefixes)))
+	}
+
+	var wg sync.WaitGroup
+	queue := make(chan string, 1024)
+	var processErr error
+	var processErrOnce sync.Once
+	var processFailed atomic.Bool
+	for i := 0; i < min(runtime.NumCPU()*8, 64); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for prefix := range queue {
+				if err := process(prefix); err != nil {
+					processErrOnce.Do(func() {
+						processErr = fmt.Errorf("failed to process prefix %s: %v", prefix, err)
+						processFailed.Store(true)
+					})
+				}
+				if bar != nil {
+					bar.Add(1)
+				}
+			}
+		}()
+	}
+	for _, prefix := range prefixes {
+		if processFailed.Load() {
+			break
+		}
+		queue <- prefix
+	}
+	close(queue)
+	wg.Wait()
+	return processErr
+}
+
 type CompromisedPasswordsAPIImporter struct {
 	client       *http.Client
 	url          string
 	mode         string
 	forceRewrite bool
+	// Prefixes downloaded without the caching headers even without forceRewrite
+	rewritePrefixes map[string]bool
+	storage         Storage
+	journal         *importJournal
+	completed       map[int]bool
+	// Number of concurrent downloads, 0 for the default
+	concurrency int
 }
 
 func (downloader *CompromisedPasswordsAPIImporter) downloadAllPrefixes() error {
 	var wg sync.WaitGroup
-	semaphore := make(chan struct{}, min(runtime.NumCPU()*8, 64))
+	concurrency := downloader.concurrency
+	if concurrency <= 0 {
+		concurrency = min(runtime.NumCPU()*8, 64)
+	}
+	semaphore := make(chan struct{}, concurrency)
 	var bar *progressbar.ProgressBar
 	if !quietFlag {
-		bar = progressbar.Default(HIBPPrefixesCount)
-	}
-	directory := filepath.Join(getStoragePath(), downloader.mode)
-	if err := os.MkdirAll(directory, 0755); err != nil {
-		return fmt.Errorf("Failed to create directory: %v", err)
+		bar = progressbar.Default(int64(HIBPPrefixesCount - len(downloader.completed)))
 	}
-	// Use a channel to communicate errors from goroutines
-	errCh := make(chan error, (HIBPPrefixesCount))
+	var failedMu sync.Mutex
+	failed := []int{}
 
-	// Iterate from 0 to 2^20 - 1
+	// Iterate from 0 to 2^20 - 1, skipping the prefixes completed before resuming
 	for i := 0; i < (HIBPPrefixesCount); i++ {
+		if downloader.completed[i] {
+			continue
+		}
 		wg.Add(1)
 		semaphore <- struct{}{} // Acquire semaphore
 		go func(prefix int) {
@@ -101,54 +438,102 @@ func (downloader *CompromisedPasswordsAPIImporter) downloadAllPrefixes() error {
 			}()
 			err := downloader.downloadByPrefix(prefix)
 			if err != nil {
-				fmt.Printf("Error downloading for prefix %d: %v\n", prefix, err)
-				errCh <- err
+				fmt.Printf("Error downloading for prefix %05X: %v\n", prefix, err)
+				if err := downloader.journal.markFailed(prefix, err); err != nil {
+					fmt.Printf("Error writing import journal: %v\n", err)
+				}
+			} else if err = downloader.journal.markDone(prefix); err != nil {
+				fmt.Printf("Error writing import journal: %v\n", err)
+			}
+			if err != nil {
+				failedMu.Lock()
+				failed = append(failed, prefix)
+				failedMu.Unlock()
 			}
 			if bar != nil {
 				bar.Add(1)
 			}
 		}(i)
 	}
+	wg.Wait()
 
-	go func() {
-		wg.Wait()
-		close(errCh)
-	}()
+	if len(failed) > 0 {
+		sort.Ints(failed)
+		printFailedPrefixes(failed)
+		return fmt.Errorf("%d prefixes failed", len(failed))
+	}
+	return nil
+}
 
-	// Check for errors from goroutines
-	for err := range errCh {
-		if err != nil {
-			return err
+// printFailedPrefixes outputs the summary of the prefixes which could not be imported
+func printFailedPrefixes(failed []int) {
+	const maxListed = 50
+	listed := make([]string, 0, maxListed)
+	for _, prefix := range failed {
+		if len(listed) == maxListed {
+			break
 		}
+		listed = append(listed, fmt.Sprintf("%05X", prefix))
 	}
-
-	return nil
+	summary := strings.Join(listed, ", ")
+	if len(failed) > maxListed {
+		summary += fmt.Sprintf(" and %d more", len(failed)-maxListed)
+	}
+	fmt.Printf("Failed prefixes (%d): %s\n", len(failed), summary)
 }
 
 func (downloader *CompromisedPasswordsAPIImporter) downloadByPrefix(prefix int) error {
 	prefixHex := strings.ToUpper(fmt.Sprintf("%05x", prefix))
-	filename := filepath.Join(getStoragePath(), downloader.mode+"/"+prefixHex+".txt")
 	url := downloader.url + prefixHex
-	if downloader.mode == "ntlm" {
-		url += "?mode=ntlm"
+	if downloader.mode != PasswordCompromiseCheckClientLib.DefaultHashFunction {
+		url += "?mode=" + downloader.mode
 	}
 	request, err := http.NewRequest(http.MethodGet, url, nil)
 	if err != nil {
 		return err
 	}
 	request.Header.Set("User-Agent", "CompromisedPasswordsImporter")
-	localETag, err := xattr.Get(filename, "user.etag")
-	if err == nil && !downloader.forceRewrite {
-		request.Header.Set("If-None-Match", string(localETag))
+	localMetadata, err := downloader.storage.Metadata(prefixHex)
+	if err == nil && localMetadata.ETag != "" && !downloader.forceRewrite && !downloader.rewritePrefixes[prefixHex] {
+		request.Header.Set("If-None-Match", localMetadata.ETag)
 	}
 	var response *http.Response
+	var records []HashRecord
 	err = retry.Do(
 		func() error {
 			var err error
 			response, err = downloader.client.Do(request)
+			if err != nil {
+				return err
+			}
+			defer response.Body.Close()
+			switch {
+			case response.StatusCode == http.StatusNotModified:
+				return nil
+			case response.StatusCode == http.StatusTooManyRequests || response.StatusCode >= 500:
+				return &upstreamStatusError{
+					status:     response.StatusCode,
+					retryAfter: parseRetryAfter(response.Header.Get("Retry-After")),
+				}
+			case response.StatusCode != http.StatusOK:
+				return retry.Unrecoverable(&upstreamStatusError{status: response.StatusCode})
+			}
+
+			body, err := io.ReadAll(response.Body)
+			if err != nil {
+				return err
+			}
+			if response.ContentLength >= 0 && int64(len(body)) != response.ContentLength {
+				return fmt.Errorf("truncated response: got %d of %d bytes", len(body), response.ContentLength)
+			}
+			records, err = parseValidatedRange(body, getSuffixLength(downloader.mode))
 			return err
 		},
 		retry.Attempts(10),
+		retry.Delay(500*time.Millisecond),
+		retry.MaxDelay(5*time.Minute),
+		retry.MaxJitter(time.Second),
+		retry.DelayType(upstreamRetryDelay),
 		retry.OnRetry(func(n uint, err error) {
 			log.Printf("Retrying request: %v", err)
 		}),
@@ -156,7 +541,6 @@ func (downloader *CompromisedPasswordsAPIImporter) downloadByPrefix(prefix int)
 	if err != nil {
 		return err
 	}
-	defer response.Body.Close()
 	if response.StatusCode == http.StatusNotModified {
 		// No update needed; local file is up-to-date
 		return nil
@@ -167,166 +551,166 @@ func (downloader *CompromisedPasswordsAPIImporter) downloadByPrefix(prefix int)
 		lastModifiedDate = time.Now().Local()
 	}
 
-	file, err := os.Create(filename)
-	if err != nil {
-		return err
-	}
-	defer file.Close()
-	// Copy the response body to the file
-	_, err = io.Copy(file, response.Body)
-	if err != nil {
-		return err
-	}
-	err = os.Chtimes(filename, lastModifiedDate, lastModifiedDate)
-	if err != nil {
-		return err
-	}
+	// The range is written to a temporary file and renamed into place by the storage
+	return downloader.storage.PutRange(prefixHex, records, PrefixMetadata{
+		ETag:         response.Header.Get("ETag"),
+		LastModified: lastModifiedDate,
+	})
+}
 
-	if etag := response.Header.Get("ETag"); etag != "" {
-		if err := xattr.Set(filename, "user.etag", []byte(etag)); err != nil {
-			return err
-		}
-	}
+// upstreamStatusError reports an unexpected response status of the upstream API
+type upstreamStatusError struct {
+	status     int
+	retryAfter time.Duration
+}
 
-	return nil
+func (err *upstreamStatusError) Error() string {
+	return fmt.Sprintf("unexpected response status: %d %s", err.status, http.StatusText(err.status))
 }
 
-type CompromisedPasswordsFileImporter struct {
-	filename string
-	mode     string
+// upstreamRetryDelay waits for the Retry-After delay if the upstream requested it,
+// otherwise it uses an exponential backoff with jitter
+func upstreamRetryDelay(n uint, err error, config *retry.Config) time.Duration {
+	var statusErr *upstreamStatusError
+	if errors.As(err, &statusErr) && statusErr.retryAfter > 0 {
+		return statusErr.retryAfter
+	}
+	return retry.CombineDelay(retry.BackOffDelay, retry.RandomDelay)(n, err, config)
 }
 
-func (importer *CompromisedPasswordsFileImporter) importAllPrefixes() error {
-	var wg sync.WaitGroup
-	semaphore := make(chan struct{}, min(runtime.NumCPU()*8, 64))
-	var bar *progressbar.ProgressBar
-	if !quietFlag {
-		bar = progressbar.Default(HIBPPrefixesCount)
+// parseRetryAfter parses the Retry-After header given either in seconds or as an HTTP date
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
 	}
-	directory := filepath.Join(getStoragePath(), importer.mode)
-	if err := os.MkdirAll(directory, 0755); err != nil {
-		return fmt.Errorf("Failed to create directory: %v", err)
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
 	}
-
-	// Use a channel to communicate errors from goroutines
-	errCh := make(chan error, (HIBPPrefixesCount))
-
-	// Iterate from 0 to 2^20 - 1
-	for i := 0; i < (HIBPPrefixesCount); i++ {
-		wg.Add(1)
-		semaphore <- struct{}{} // Acquire semaphore
-		go func(prefix int) {
-			defer func() {
-				<-semaphore // Release semaphore
-				wg.Done()
-			}()
-			err := importer.importByPrefix(prefix)
-			if err != nil {
-				fmt.Printf("Error importing for prefix %d: %v\n", prefix, err)
-				errCh <- err
-			}
-			bar.Add(1)
-		}(i)
+	if date, err := http.ParseTime(value); err == nil {
+		return time.Until(date)
 	}
+	return 0
+}
 
-	go func() {
-		wg.Wait()
-		close(errCh)
-	}()
-
-	// Check for errors from goroutines
-	for err := range errCh {
-		if err != nil {
-			return err
-		}
-	}
+type CompromisedPasswordsFileImporter struct {
+	filename   string
+	mode       string
+	storage    Storage
+	inputOrder string
+	sortMemory int
+	tempDir    string
+}
 
-	return nil
+// prefixRange is a completed prefix waiting to be written to the storage
+type prefixRange struct {
+	prefix  int
+	records []HashRecord
 }
 
-func (importer *CompromisedPasswordsFileImporter) importByPrefix(prefix int) error {
-	prefixHex := strings.ToUpper(fmt.Sprintf("%05x", prefix))
-	filename := filepath.Join(getStoragePath(), importer.mode+"/"+prefixHex+".txt")
-	data, err := importer.readDataForPrefix(prefixHex)
+// importAllPrefixes reads the input once, in hash order, and writes every prefix as soon as it is completed.
+// Inputs ordered by count are sorted by hash first, using an external merge sort.
+func (importer *CompromisedPasswordsFileImporter) importAllPrefixes() error {
+	input, err := openImportInput(importer.filename)
 	if err != nil {
 		return err
 	}
+	defer input.Close()
 
-	file, err := os.Create(filename)
-	if err != nil {
-		return err
+	var reader hashRecordReader = newLineRecordReader(input, getSuffixLength(importer.mode))
+	if importer.inputOrder == "count" {
+		if !quietFlag {
+			fmt.Println("Sorting the input by hash...")
+		}
+		sorted, err := sortRecords(reader, importer.sortMemory, importer.tempDir)
+		if err != nil {
+			return fmt.Errorf("failed to sort the input: %v", err)
+		}
+		defer sorted.Close()
+		reader = sorted
 	}
-	defer file.Close()
 
-	_, err = file.WriteString(data)
-	if err != nil {
-		return err
+	var bar *progressbar.ProgressBar
+	if !quietFlag {
+		bar = progressbar.Default(HIBPPrefixesCount)
 	}
 
-	currentDate := time.Now()
-	err = os.Chtimes(filename, currentDate, currentDate)
-	if err != nil {
-		return err
+	// Completed prefixes are written concurrently, the first error stops the import
+	var wg sync.WaitGroup
+	ranges := make(chan prefixRange, 1024)
+	var writeErr error
+	var writeErrOnce sync.Once
+	var writeFailed atomic.Bool
+	for i := 0; i < min(runtime.NumCPU()*8, 64); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for prefixRange := range ranges {
+				prefixHex := fmt.Sprintf("%05X", prefixRange.prefix)
+				err := importer.storage.PutRange(prefixHex, prefixRange.records, PrefixMetadata{LastModified: time.Now()})
+				if err != nil {
+					writeErrOnce.Do(func() {
+						writeErr = fmt.Errorf("failed to write prefix %s: %v", prefixHex, err)
+						writeFailed.Store(true)
+					})
+				}
+				if bar != nil {
+					bar.Add(1)
+				}
+			}
+		}()
 	}
 
-	return nil
+	readErr := importer.streamPrefixes(reader, ranges, writeFailed.Load)
+	close(ranges)
+	wg.Wait()
+	if readErr != nil {
+		return readErr
+	}
+	return writeErr
 }
 
-// getRange retrieves the Pwned password leak record range from the data file.
-func (importer *CompromisedPasswordsFileImporter) readDataForPrefix(prefix string) (string, error) {
-	// Helper function to find the offset
-	findOffset := func(start, end int64, dataFile *os.File) int64 {
-		var mid int64
-		for start+1 < end {
-			mid = (start + end) / 2
-			dataFile.Seek(mid, 0)
-			reader := bufio.NewReader(dataFile)
-			reader.ReadString('\n') // Skip possibly partial line
-			line, err := reader.ReadString('\n')
-			if err != nil {
-				break // EOF
-			}
-			linePrefix := line[:5]
-			if linePrefix < prefix {
-				start = mid
-			} else {
-				end = mid
+// streamPrefixes groups the hash-ordered records by prefix and sends every prefix (including
+// the empty ones) to the channel
+func (importer *CompromisedPasswordsFileImporter) streamPrefixes(reader hashRecordReader, ranges chan<- prefixRange, stopped func() bool) error {
+	current := 0
+	var records []HashRecord
+	lastHash := ""
+	for {
+		hash, count, err := reader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if hash < lastHash {
+			return fmt.Errorf("the input is not sorted by hash (%s follows %s), use \"--input-order count\"", hash, lastHash)
+		}
+		prefix, _ := parsePrefix(hash[:5])
+		for current < prefix {
+			if stopped() {
+				return nil
 			}
+			ranges <- prefixRange{prefix: current, records: records}
+			records = nil
+			current++
 		}
-		if start != 0 {
-			return end
+		if hash == lastHash {
+			// Keep a single record for duplicated hashes
+			last := &records[len(records)-1]
+			last.Count = max(last.Count, count)
+			continue
 		}
-		return start
-	}
-
-	// Open the data file
-	file, err := os.Open(importer.filename)
-	if err != nil {
-		return "", err
+		records = append(records, HashRecord{Suffix: hash[5:], Count: count})
+		lastHash = hash
 	}
-	defer file.Close()
-
-	// Find start offset of the prefix
-	var startOffset int64
-	file.Seek(0, 2) // Move to end of file to get size
-	endOffset, _ := file.Seek(0, 1)
-	startOffset = findOffset(0, endOffset, file)
-	// Read and process the lines between the found offsets
-	file.Seek(startOffset, 0)
-
-	results := []string{}
-	scanner := bufio.NewScanner(file)
-	if startOffset != 0 {
-		scanner.Scan()
-	}
-	for scanner.Scan() {
-		line := scanner.Text()
-		if !strings.HasPrefix(line, prefix) {
-			break
+	for ; current < HIBPPrefixesCount; current++ {
+		if stopped() {
+			return nil
 		}
-		results = append(results, strings.TrimSpace(line[5:]))
+		ranges <- prefixRange{prefix: current, records: records}
+		records = nil
 	}
-	return strings.Join(results, "\n"), nil
+	return nil
 }
 
 var exportCmd = &cobra.Command{
@@ -335,8 +719,8 @@ var exportCmd = &cobra.Command{
 	Long:  `Export compromised passwords to a file.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		mode, _ := cmd.Flags().GetString("hash-function")
-		if mode != "sha1" && mode != "ntlm" {
-			fmt.Printf("Error: incorrect \"hash-function\" parameter value. Allowed values: \"sha1\", \"ntlm\"\n")
+		if err := validateHashFunction(mode); err != nil {
+			fmt.Printf("Error: %v\n", err)
 			return
 		}
 		filePath, _ := cmd.Flags().GetString("file")
@@ -353,7 +737,7 @@ var exportCmd = &cobra.Command{
 }
 
 func initExportCmd() {
-	exportCmd.Flags().String("hash-function", "sha1", "Hash function to validate (SHA-1 or NTLM)")
+	exportCmd.Flags().String("hash-function", PasswordCompromiseCheckClientLib.DefaultHashFunction, "Hash function to export: "+hashFunctionsList())
 	exportCmd.Flags().StringP("file", "f", "", "Path to the file for saving hash values")
 }
 
@@ -388,10 +772,16 @@ func exportHashValues(mode, filePath string) error {
 		bar = progressbar.Default(HIBPPrefixesCount)
 	}
 
+	storage, err := openServedStorage(mode)
+	if err != nil {
+		return fmt.Errorf("failed to open storage: %v", err)
+	}
+	defer storage.Close()
+
 	// Iterate over all possible prefixes
 	for i := 0; i <= 0xFFFFF; i++ { // Hexadecimal range from 0x00000 to 0xFFFFF
 		prefix := fmt.Sprintf("%05X", i)
-		data, err := fetchHashData(prefix, mode)
+		data, err := fetchHashData(storage, prefix)
 		if err != nil {
 			return err
 		}
@@ -407,28 +797,16 @@ func exportHashValues(mode, filePath string) error {
 	return nil
 }
 
-func fetchHashData(prefix, mode string) (string, error) {
-	folderPath := mode
-	filename := filepath.Join(getStoragePath(), folderPath, prefix+".txt")
-
-	file, err := os.Open(filename)
+func fetchHashData(storage Storage, prefix string) (string, error) {
+	records, err := storage.GetRange(prefix)
 	if err != nil {
-		return "", fmt.Errorf("failed to open file: %v", err)
+		return "", fmt.Errorf("failed to read prefix %s: %v", prefix, err)
 	}
-	defer file.Close()
 
-	scanner := bufio.NewScanner(file)
 	var result strings.Builder
-	for scanner.Scan() {
-		line := scanner.Text()
-		if line != "" {
-			// Append the prefix and the line content
-			result.WriteString(fmt.Sprintf("%s%s\n", prefix, line))
-		}
-	}
-
-	if err := scanner.Err(); err != nil {
-		return "", fmt.Errorf("error reading file: %v", err)
+	for _, record := range records {
+		// Append the prefix and the record content
+		result.WriteString(fmt.Sprintf("%s%s:%d\n", prefix, record.Suffix, record.Count))
 	}
 
 	return result.String(), nil
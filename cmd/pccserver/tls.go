@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Endpoints of run-server, as named by the "require-client-cert" option
+var serverEndpoints = []string{"range", "pwnedpassword", "psi", "admin"}
+
+// Minimal interval between the checks of the certificate files for changes
+const certificateCheckInterval = 5 * time.Second
+
+// certificateReloader serves the certificate and reloads it when the certificate or the key file changes,
+// so rotated certificates are picked up without a restart
+type certificateReloader struct {
+	certPath    string
+	keyPath     string
+	mu          sync.Mutex
+	certificate *tls.Certificate
+	// Modification times of the loaded files
+	certModTime time.Time
+	keyModTime  time.Time
+	checkedAt   time.Time
+}
+
+func newCertificateReloader(certPath, keyPath string) (*certificateReloader, error) {
+	reloader := &certificateReloader{certPath: certPath, keyPath: keyPath}
+	if err := reloader.load(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+// load reads the certificate and the key. The caller holds the lock, except at construction.
+func (reloader *certificateReloader) load() error {
+	certModTime, keyModTime, err := reloader.modTimes()
+	if err != nil {
+		return err
+	}
+	certificate, err := tls.LoadX509KeyPair(reloader.certPath, reloader.keyPath)
+	if err != nil {
+		return fmt.Errorf("failed to load the TLS certificate: %v", err)
+	}
+	reloader.certificate = &certificate
+	reloader.certModTime = certModTime
+	reloader.keyModTime = keyModTime
+	return nil
+}
+
+func (reloader *certificateReloader) modTimes() (time.Time, time.Time, error) {
+	certInfo, err := os.Stat(reloader.certPath)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	keyInfo, err := os.Stat(reloader.keyPath)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return certInfo.ModTime(), keyInfo.ModTime(), nil
+}
+
+// getCertificate is the tls.Config.GetCertificate callback. If the reloaded files are invalid
+// (e.g. the certificate is replaced before the key), the previous certificate is served.
+func (reloader *certificateReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	reloader.mu.Lock()
+	defer reloader.mu.Unlock()
+	if time.Since(reloader.checkedAt) >= certificateCheckInterval {
+		reloader.checkedAt = time.Now()
+		certModTime, keyModTime, err := reloader.modTimes()
+		if err == nil && (!certModTime.Equal(reloader.certModTime) || !keyModTime.Equal(reloader.keyModTime)) {
+			if err := reloader.load(); err != nil {
+				fmt.Printf("Error reloading the TLS certificate: %v, the previous certificate is still served\n", err)
+			} else if !quietFlag {
+				fmt.Println("Reloaded the TLS certificate")
+			}
+		}
+	}
+	return reloader.certificate, nil
+}
+
+// newServerTLSConfig returns the TLS configuration of run-server. With a client CA the client
+// certificates are verified when they are given, the endpoints requiring them are checked per request.
+func newServerTLSConfig(certPath, keyPath, clientCAPath string) (*tls.Config, error) {
+	if certPath == "" || keyPath == "" {
+		return nil, fmt.Errorf("both \"tls-cert\" and \"tls-key\" are required for TLS")
+	}
+	reloader, err := newCertificateReloader(certPath, keyPath)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.getCertificate,
+	}
+	if clientCAPath != "" {
+		data, err := os.ReadFile(clientCAPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the client CA: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in %s", clientCAPath)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
+
+// parseClientCertEndpoints parses the comma-separated "require-client-cert" option value
+func parseClientCertEndpoints(value string) (map[string]bool, error) {
+	endpoints := map[string]bool{}
+	for _, endpoint := range strings.Split(value, ",") {
+		endpoint = strings.TrimSpace(endpoint)
+		switch endpoint {
+		case "", "none":
+		case "all":
+			for _, name := range serverEndpoints {
+				endpoints[name] = true
+			}
+		default:
+			found := false
+			for _, name := range serverEndpoints {
+				if endpoint == name {
+					found = true
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("incorrect \"require-client-cert\" option value %q. Allowed values: \"all\", \"none\" or a comma-separated list of %s", endpoint, strings.Join(serverEndpoints, ", "))
+			}
+			endpoints[endpoint] = true
+		}
+	}
+	return endpoints, nil
+}
+
+// requireClientCertificate refuses the requests without a verified client certificate
+func requireClientCertificate(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			http.Error(w, "A client certificate is required", http.StatusForbidden)
+			return
+		}
+		handler(w, r)
+	}
+}
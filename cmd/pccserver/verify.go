@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/spf13/cobra"
+)
+
+// The checksum manifest (<data>/<folder>.manifest) lists a "PREFIX CHECKSUM" line for every stored prefix.
+// The checksum is the SHA-256 of the range in the HIBP response format, as stored in the prefix file,
+// so a signed manifest (see signing.go) also authenticates the values.
+
+var verifyCmd = &cobra.Command{
+	Use:   "verify-storage",
+	Short: "Verify the integrity of the served storage",
+	Long:  `Check that every prefix of the served hash functions is present, well-formed, sorted and matches the checksum manifest written at import time.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		hashFunction, _ := cmd.Flags().GetString("hash-function")
+		repair, _ := cmd.Flags().GetBool("repair")
+		url, _ := cmd.Flags().GetString("url")
+		var signingKey ed25519.PrivateKey
+		if repair {
+			lock, err := lockStorage(cmd)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+			defer lock.unlock()
+			if signKeyPath, _ := cmd.Flags().GetString("sign-key"); signKeyPath != "" {
+				signingKey, err = loadSigningKey(signKeyPath)
+				if err != nil {
+					fmt.Printf("Error loading signing key: %v\n", err)
+					os.Exit(1)
+				}
+			}
+		}
+
+		hashFunctions, err := getSupportedHashFunctions()
+		if err != nil {
+			fmt.Printf("Error reading state: %v\n", err)
+			os.Exit(1)
+		}
+		if hashFunction != "" {
+			if err := validateHashFunction(hashFunction); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+			hashFunctions = []string{hashFunction}
+		}
+
+		healthy := true
+		for _, mode := range hashFunctions {
+			if !quietFlag {
+				fmt.Printf("Verifying %s storage...\n", mode)
+			}
+			bad, err := verifyStorage(getDataPath(), mode)
+			if err != nil {
+				fmt.Printf("Error verifying %s storage: %v\n", mode, err)
+				healthy = false
+				continue
+			}
+			if len(bad) == 0 {
+				if !quietFlag {
+					fmt.Printf("The %s storage is valid\n", mode)
+				}
+				continue
+			}
+			printBadPrefixes(mode, bad)
+			if !repair {
+				healthy = false
+				continue
+			}
+			if err := repairPrefixes(mode, bad, url, signingKey); err != nil {
+				fmt.Printf("Error repairing %s storage: %v\n", mode, err)
+				healthy = false
+				continue
+			}
+			if !quietFlag {
+				fmt.Printf("%d %s prefixes downloaded again\n", len(bad), mode)
+			}
+		}
+		if !healthy {
+			os.Exit(1)
+		}
+	},
+}
+
+func initVerifyCmd() {
+	verifyCmd.Flags().String("hash-function", "", "Hash function to verify (by default all supported hash functions)")
+	verifyCmd.Flags().Bool("repair", false, "Download the bad prefixes again into a new generation")
+	verifyCmd.Flags().StringP("url", "u", "", "External password compromise checking API URL for the repair (by default the URL the values were imported from; required for the values imported from files)")
+	verifyCmd.Flags().String("sign-key", "", "Ed25519 private key file (PEM, PKCS #8) to sign the checksum manifests of the repaired generation with, required if the storage is signed")
+}
+
+func getManifestPath(dataPath, mode string) string {
+	return filepath.Join(dataPath, getHashFunctionFolder(mode)+".manifest")
+}
+
+// readRawRange returns the range of the prefix in the HIBP response format
+func readRawRange(storage Storage, prefix string) ([]byte, error) {
+	if directory, ok := storage.(*directoryStorage); ok {
+		data, err := os.ReadFile(directory.prefixPath(prefix))
+		if os.IsNotExist(err) {
+			return nil, errPrefixNotFound
+		}
+		return data, err
+	}
+	records, err := storage.GetRange(prefix)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(formatRange(records)), nil
+}
+
+func rangeChecksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// writeManifest replaces the manifest with the checksums of the prefixes. The manifest is
+// written to a temporary file and renamed, as the previous one may be hard-linked from other generations.
+func writeManifest(dataPath, mode string, checksums map[string]string) error {
+	path := getManifestPath(dataPath, mode)
+	tmpPath := path + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("failed to create manifest: %v", err)
+	}
+	defer os.Remove(tmpPath)
+	defer file.Close()
+
+	prefixes := make([]string, 0, len(checksums))
+	for prefix := range checksums {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	writer := bufio.NewWriter(file)
+	for _, prefix := range prefixes {
+		fmt.Fprintf(writer, "%s %s\n", prefix, checksums[prefix])
+	}
+	if err := writer.Flush(); err != nil {
+		return fmt.Errorf("failed to write manifest: %v", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to write manifest: %v", err)
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// readManifest returns the checksums of the manifest, nil if there is no manifest
+func readManifest(dataPath, mode string) (map[string]string, error) {
+	file, err := os.Open(getManifestPath(dataPath, mode))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	checksums := map[string]string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		prefix, checksum, found := strings.Cut(scanner.Text(), " ")
+		if !found {
+			return nil, fmt.Errorf("malformed manifest line: %q", scanner.Text())
+		}
+		checksums[prefix] = checksum
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %v", err)
+	}
+	return checksums, nil
+}
+
+// verifyStorage checks every prefix of the mode in the data directory and returns the problems by prefix
+func verifyStorage(dataPath, mode string) (map[string]string, error) {
+	manifest, err := readManifest(dataPath, mode)
+	if err != nil {
+		return nil, err
+	}
+	if manifest == nil {
+		fmt.Printf("Warning: there is no %s checksum manifest, the checksums are not verified\n", mode)
+	}
+	storage, err := openStorage(dataPath, mode)
+	if err != nil {
+		return nil, err
+	}
+	defer storage.Close()
+	suffixLength := getSuffixLength(mode)
+
+	var badMu sync.Mutex
+	bad := map[string]string{}
+	err = processPrefixes(nil, func(prefix string) error {
+		problem := verifyPrefix(storage, prefix, suffixLength, manifest)
+		if problem != "" {
+			badMu.Lock()
+			bad[prefix] = problem
+			badMu.Unlock()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return bad, nil
+}
+
+// verifyPrefix returns the problem of the range of the prefix, or an empty string if the range is valid
+func verifyPrefix(storage Storage, prefix string, suffixLength int, manifest map[string]string) string {
+	data, err := readRawRange(storage, prefix)
+	if err != nil {
+		if err == errPrefixNotFound {
+			return "missing"
+		}
+		return err.Error()
+	}
+	records, err := parseValidatedRange(data, suffixLength)
+	if err != nil {
+		return err.Error()
+	}
+	for i := 1; i < len(records); i++ {
+		if records[i-1].Suffix == records[i].Suffix {
+			return fmt.Sprintf("duplicate suffix %s", records[i].Suffix)
+		}
+		if records[i-1].Suffix > records[i].Suffix {
+			return fmt.Sprintf("suffix %s is out of order", records[i].Suffix)
+		}
+	}
+	if manifest != nil {
+		expected, found := manifest[prefix]
+		if !found {
+			return "not listed in the manifest"
+		}
+		if checksum := rangeChecksum(data); checksum != expected {
+			return fmt.Sprintf("checksum %s does not match the manifest checksum %s", checksum, expected)
+		}
+	}
+	return ""
+}
+
+func printBadPrefixes(mode string, bad map[string]string) {
+	const maxListed = 50
+	prefixes := make([]string, 0, len(bad))
+	for prefix := range bad {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	fmt.Printf("Bad %s prefixes (%d):\n", mode, len(prefixes))
+	for i, prefix := range prefixes {
+		if i == maxListed {
+			fmt.Printf("  and %d more\n", len(prefixes)-maxListed)
+			break
+		}
+		fmt.Printf("  %s: %s\n", prefix, bad[prefix])
+	}
+}
+
+// repairPrefixes downloads the bad prefixes again into a new generation, which is activated when all of them succeed.
+// The manifests of the generation are signed with the signing key if it is given.
+func repairPrefixes(mode string, bad map[string]string, url string, signingKey ed25519.PrivateKey) error {
+	state, err := readStateFile()
+	if err != nil {
+		return fmt.Errorf("failed to read state file: %v", err)
+	}
+	exclusions, err := readExclusions()
+	if err != nil {
+		return fmt.Errorf("failed to read exclusions: %v", err)
+	}
+	// The values imported from a file are not downloaded from an API unless it is given explicitly,
+	// as its ranges may come from another release than the file
+	dataset := state.Datasets[mode]
+	if url == "" {
+		if !strings.HasPrefix(dataset.Source, "http://") && !strings.HasPrefix(dataset.Source, "https://") {
+			return fmt.Errorf("the %s values were imported from %q, which cannot be downloaded again; give the API to repair from with \"url\"", mode, dataset.Source)
+		}
+		url = dataset.Source
+	}
+	if _, err := os.Stat(getPackedStoragePath(getDataPath(), mode)); err == nil {
+		return fmt.Errorf("packed storages cannot be repaired, import the values again")
+	}
+	// The signature of the repaired manifest would not verify
+	if _, err := os.Stat(getManifestSignaturePath(getDataPath(), mode)); err == nil && signingKey == nil {
+		return fmt.Errorf("the %s manifest is signed, give the key to sign the repaired generation with \"sign-key\"", mode)
+	}
+
+	generation, err := createGeneration()
+	if err != nil {
+		return fmt.Errorf("failed to create storage generation: %v", err)
+	}
+	generationPath := getGenerationPath(generation)
+	storage := withExclusions(newWritableDirectoryStorage(generationPath, mode), exclusions, mode)
+	if dataset.MinCount > 0 {
+		storage = &minCountStorage{Storage: storage, minCount: dataset.MinCount}
+	}
+	journal, _, _, err := openImportJournal(generationPath)
+	if err != nil {
+		discardGeneration(generation)
+		return fmt.Errorf("failed to open import journal: %v", err)
+	}
+
+	completed := map[int]bool{}
+	for prefix := 0; prefix < HIBPPrefixesCount; prefix++ {
+		if _, found := bad[fmt.Sprintf("%05X", prefix)]; !found {
+			completed[prefix] = true
+		}
+	}
+	var cpd CompromisedPasswordsAPIImporter
+	cpd.url = url
+	cpd.client = &http.Client{}
+	cpd.mode = mode
+	// The cached ETags of the corrupted prefixes are not trusted
+	cpd.forceRewrite = true
+	cpd.storage = storage
+	cpd.journal = journal
+	cpd.completed = completed
+	if !quietFlag {
+		fmt.Printf("Downloading %d %s prefixes again from %s\n", len(bad), mode, url)
+	}
+	err = cpd.downloadAllPrefixes()
+	journal.Close()
+	removeImportJournal(generationPath)
+	if err != nil {
+		discardGeneration(generation)
+		return err
+	}
+	return activateGeneration(generation, map[string]Dataset{mode: dataset}, signingKey)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/petrkamnev/password-compromise-check-server/pkg/PasswordCompromiseCheckClientLib"
+)
+
+// CompromisedPasswordsWordlistImporter hashes the passwords of a plaintext wordlist (one per line)
+// and merges them into the prefix files of every registered hash function
+type CompromisedPasswordsWordlistImporter struct {
+	filename string
+	count    uint64
+	dataPath string
+	// sparse data directories (sources) only get the prefixes of the wordlist
+	sparse bool
+}
+
+func (importer *CompromisedPasswordsWordlistImporter) importWordlist() error {
+	exclusions, err := readExclusions()
+	if err != nil {
+		return fmt.Errorf("failed to read exclusions: %v", err)
+	}
+	input, err := openImportInput(importer.filename)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+
+	// Suffix sets by prefix for each hash function, duplicate passwords collapse into one suffix
+	hashFunctions := PasswordCompromiseCheckClientLib.HashFunctions()
+	suffixes := map[string]map[string]map[string]bool{}
+	for _, hashFunction := range hashFunctions {
+		suffixes[hashFunction.Name] = map[string]map[string]bool{}
+	}
+	passwordsCount := 0
+	scanner := bufio.NewScanner(input)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		password := strings.TrimSuffix(scanner.Text(), "\r")
+		if password == "" {
+			continue
+		}
+		passwordsCount++
+		for _, hashFunction := range hashFunctions {
+			hash := hashFunction.Hash(password)
+			prefix, suffix := hash[:PasswordCompromiseCheckClientLib.PrefixLength], hash[PasswordCompromiseCheckClientLib.PrefixLength:]
+			prefixSuffixes := suffixes[hashFunction.Name][prefix]
+			if prefixSuffixes == nil {
+				prefixSuffixes = map[string]bool{}
+				suffixes[hashFunction.Name][prefix] = prefixSuffixes
+			}
+			prefixSuffixes[suffix] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read the wordlist: %v", err)
+	}
+	if passwordsCount == 0 {
+		return fmt.Errorf("the wordlist contains no passwords")
+	}
+
+	for _, hashFunction := range hashFunctions {
+		mode := hashFunction.Name
+		if !quietFlag {
+			fmt.Printf("Merging %d passwords into the %s storage...\n", passwordsCount, mode)
+		}
+		if err := importer.mergeSuffixes(mode, suffixes[mode], exclusions); err != nil {
+			return fmt.Errorf("failed to import %s hashes: %v", mode, err)
+		}
+	}
+	return nil
+}
+
+// mergeSuffixes adds the suffixes to the prefix files of the mode. A packed storage is rewritten
+// as a set of prefix files which supersedes the packed file.
+func (importer *CompromisedPasswordsWordlistImporter) mergeSuffixes(mode string, suffixes map[string]map[string]bool, exclusions Exclusions) error {
+	source, err := openStorage(importer.dataPath, mode)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	target := withExclusions(newWritableDirectoryStorage(importer.dataPath, mode), exclusions, mode)
+
+	// Packed storages and the served storages missing prefixes are completed, sources may stay sparse
+	writeAll := true
+	if _, ok := source.(*directoryStorage); ok {
+		prefixes, err := source.ListPrefixes()
+		if err != nil {
+			return err
+		}
+		writeAll = !importer.sparse && len(prefixes) != HIBPPrefixesCount
+	}
+
+	selected := func(prefix string) bool {
+		return suffixes[prefix] != nil
+	}
+	if writeAll {
+		selected = nil
+	}
+	err = processPrefixes(selected, func(prefix string) error {
+		return importer.mergePrefix(source, target, prefix, suffixes[prefix])
+	})
+	if err != nil {
+		return err
+	}
+
+	// The prefix files are complete now and supersede the packed file
+	if err := os.Remove(getPackedStoragePath(importer.dataPath, mode)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// mergePrefix writes the union of the stored records and the wordlist suffixes.
+// The count of a suffix already present becomes the larger of both counts.
+func (importer *CompromisedPasswordsWordlistImporter) mergePrefix(source Storage, target Storage, prefix string, suffixes map[string]bool) error {
+	records, err := source.GetRange(prefix)
+	if err != nil && err != errPrefixNotFound {
+		return err
+	}
+	merged := make([]HashRecord, 0, len(records)+len(suffixes))
+	for _, record := range records {
+		if suffixes[record.Suffix] {
+			record.Count = max(record.Count, importer.count)
+		}
+		merged = append(merged, record)
+	}
+	for _, record := range records {
+		delete(suffixes, record.Suffix)
+	}
+	for suffix := range suffixes {
+		merged = append(merged, HashRecord{Suffix: suffix, Count: importer.count})
+	}
+	sort.Slice(merged, func(i, j int) bool {
+		return merged[i].Suffix < merged[j].Suffix
+	})
+	return target.PutRange(prefix, merged, PrefixMetadata{LastModified: time.Now()})
+}
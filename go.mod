@@ -2,7 +2,11 @@ module PasswordCompromiseCheckProject
 
 require (
 	github.com/avast/retry-go v3.0.0+incompatible
+	github.com/fsnotify/fsnotify v1.7.0
+	github.com/klauspost/compress v1.17.4
 	github.com/schollz/progressbar/v3 v3.14.1
+	golang.org/x/crypto v0.17.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -30,7 +34,6 @@ require (
 	golang.org/x/sys v0.15.0 // indirect
 	golang.org/x/term v0.15.0 // indirect
 	gopkg.in/yaml.v2 v2.4.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
 
 go 1.21
@@ -2,8 +2,6 @@ package PasswordCompromiseCheckClientLib
 
 import (
 	"bytes"
-	"crypto/sha1"
-	"encoding/hex"
 	"fmt"
 	"io"
 	"strings"
@@ -16,18 +14,20 @@ import (
 	"google.golang.org/protobuf/proto"
 )
 
-func CheckSHA1Password(password string, url string) (bool, error) {
-	hash := sha1.New()
-	hash.Write([]byte(password))
-	hashBytes := hash.Sum(nil)
-	hashString := hex.EncodeToString(hashBytes)
-	prefix := hashString[:5]
-	suffix := strings.ToUpper(hashString[5:])
-	response, err := http.Get(url + "/range/" + prefix)
+// CheckPassword checks whether the hash of the password is listed in its range
+func CheckPassword(hashFunctionName string, password string, url string) (bool, error) {
+	hashFunction, prefix, suffix, err := splitPasswordHash(hashFunctionName, password)
+	if err != nil {
+		return false, err
+	}
+	response, err := http.Get(url + "/range/" + prefix + modeQuery(hashFunction))
 	if err != nil {
 		return false, err
 	}
 	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("Received non-200 response status: %d %s", response.StatusCode, response.Status)
+	}
 	body, err := io.ReadAll(response.Body)
 	if err != nil {
 		return false, err
@@ -35,13 +35,13 @@ func CheckSHA1Password(password string, url string) (bool, error) {
 	return strings.Contains(string(body), suffix), nil
 }
 
-func CheckSHA1PSIPassword(password string, url string) (bool, error) {
-	hash := sha1.New()
-	hash.Write([]byte(password))
-	hashBytes := hash.Sum(nil)
-	hashString := hex.EncodeToString(hashBytes)
-	prefix := hashString[:5]
-	suffix := strings.ToUpper(hashString[5:])
+// CheckPSIPassword checks whether the hash of the password is listed in its range using PSI,
+// so the server learns neither the hash suffix nor the result
+func CheckPSIPassword(hashFunctionName string, password string, url string) (bool, error) {
+	hashFunction, prefix, suffix, err := splitPasswordHash(hashFunctionName, password)
+	if err != nil {
+		return false, err
+	}
 	client, err := psi_client.CreateWithNewKey(true)
 	if err != nil {
 		return false, fmt.Errorf("Failed to create a PSI client: %v", err)
@@ -56,7 +56,7 @@ func CheckSHA1PSIPassword(password string, url string) (bool, error) {
 		return false, fmt.Errorf("Failed to serialize request: %v", err)
 	}
 
-	response, err := http.Post(url+"/psi/"+prefix, "application/octet-stream", bytes.NewBuffer(serializedRequest))
+	response, err := http.Post(url+"/psi/"+prefix+modeQuery(hashFunction), "application/octet-stream", bytes.NewBuffer(serializedRequest))
 	if err != nil {
 		return false, fmt.Errorf("Error sending data to server: %v", err)
 	}
@@ -73,14 +73,14 @@ func CheckSHA1PSIPassword(password string, url string) (bool, error) {
 	psiResponseLength, err1 := strconv.Atoi(psiResponseLengthHeader)
 	psiSetupLength, err2 := strconv.Atoi(psiSetupLengthHeader)
 	if err1 != nil || err2 != nil {
-		return false, fmt.Errorf("Error converting message lengths to integers:", err1, err2)
+		return false, fmt.Errorf("Error converting message lengths to integers: %v, %v", err1, err2)
 	}
 
 	// Read the serialized messages from the response body
 	psiResponseSerialized, err1 := io.ReadAll(io.LimitReader(response.Body, int64(psiResponseLength)))
 	psiSetupSerialized, err2 := io.ReadAll(io.LimitReader(response.Body, int64(psiSetupLength)))
 	if err1 != nil || err2 != nil {
-		return false, fmt.Errorf("Error reading psi data:", err1, err2)
+		return false, fmt.Errorf("Error reading psi data: %v, %v", err1, err2)
 	}
 	psiResponse := &psi_proto.Response{}
 	err = proto.Unmarshal(psiResponseSerialized, psiResponse)
@@ -99,3 +99,45 @@ func CheckSHA1PSIPassword(password string, url string) (bool, error) {
 	}
 	return intersectionSize != 0, nil
 }
+
+// splitPasswordHash hashes the password and splits the hash into the range prefix and the suffix
+func splitPasswordHash(hashFunctionName string, password string) (HashFunction, string, string, error) {
+	hashFunction, ok := LookupHashFunction(hashFunctionName)
+	if !ok {
+		return HashFunction{}, "", "", fmt.Errorf("unsupported hash function: %s", hashFunctionName)
+	}
+	hash := hashFunction.Hash(password)
+	return hashFunction, hash[:PrefixLength], hash[PrefixLength:], nil
+}
+
+// modeQuery returns the query selecting the hash function, the default one needs none
+func modeQuery(hashFunction HashFunction) string {
+	if hashFunction.Name == DefaultHashFunction {
+		return ""
+	}
+	return "?mode=" + hashFunction.Name
+}
+
+func CheckSHA1Password(password string, url string) (bool, error) {
+	return CheckPassword("sha1", password, url)
+}
+
+func CheckSHA1PSIPassword(password string, url string) (bool, error) {
+	return CheckPSIPassword("sha1", password, url)
+}
+
+func CheckNTLMPassword(password string, url string) (bool, error) {
+	return CheckPassword("ntlm", password, url)
+}
+
+func CheckNTLMPSIPassword(password string, url string) (bool, error) {
+	return CheckPSIPassword("ntlm", password, url)
+}
+
+func CheckSHA256Password(password string, url string) (bool, error) {
+	return CheckPassword("sha256", password, url)
+}
+
+func CheckSHA256PSIPassword(password string, url string) (bool, error) {
+	return CheckPSIPassword("sha256", password, url)
+}
@@ -0,0 +1,88 @@
+package PasswordCompromiseCheckClientLib
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"strings"
+	"unicode/utf16"
+
+	"golang.org/x/crypto/md4"
+)
+
+// PrefixLength is the length of the hash prefix identifying a range
+const PrefixLength = 5
+
+// DefaultHashFunction is used when no hash function ("mode") is given
+const DefaultHashFunction = "sha1"
+
+// HashFunction describes a hash function supported by the password compromise check server
+type HashFunction struct {
+	// Name is the value of the "mode" query parameter and of the "hash-function" flags
+	Name string
+	// DigestLength is the length of the hex-encoded hash
+	DigestLength int
+	// Hash returns the uppercase hex-encoded hash of the password
+	Hash func(password string) string
+	// Folder is the storage directory of the hash function
+	Folder string
+}
+
+// SuffixLength is the length of the hash suffixes listed in a range
+func (hashFunction HashFunction) SuffixLength() int {
+	return hashFunction.DigestLength - PrefixLength
+}
+
+// hashFunctions is the registry of the supported hash functions, in the order they are listed
+var hashFunctions = []HashFunction{
+	{Name: "sha1", DigestLength: 40, Hash: sha1Hex, Folder: "sha1"},
+	{Name: "ntlm", DigestLength: 32, Hash: ntlmHex, Folder: "ntlm"},
+	{Name: "sha256", DigestLength: 64, Hash: sha256Hex, Folder: "sha256"},
+}
+
+// HashFunctions returns the supported hash functions
+func HashFunctions() []HashFunction {
+	return append([]HashFunction{}, hashFunctions...)
+}
+
+// LookupHashFunction returns the hash function with the given name
+func LookupHashFunction(name string) (HashFunction, bool) {
+	for _, hashFunction := range hashFunctions {
+		if hashFunction.Name == name {
+			return hashFunction, true
+		}
+	}
+	return HashFunction{}, false
+}
+
+// HashFunctionNames returns the names of the supported hash functions
+func HashFunctionNames() []string {
+	names := make([]string, len(hashFunctions))
+	for i, hashFunction := range hashFunctions {
+		names[i] = hashFunction.Name
+	}
+	return names
+}
+
+func sha1Hex(password string) string {
+	sum := sha1.Sum([]byte(password))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+func sha256Hex(password string) string {
+	sum := sha256.Sum256([]byte(password))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+// ntlmHex returns the NT hash: MD4 over the UTF-16LE encoding of the password
+func ntlmHex(password string) string {
+	encoded := utf16.Encode([]rune(password))
+	buf := make([]byte, 2*len(encoded))
+	for i, c := range encoded {
+		binary.LittleEndian.PutUint16(buf[2*i:], c)
+	}
+	hash := md4.New()
+	hash.Write(buf)
+	return strings.ToUpper(hex.EncodeToString(hash.Sum(nil)))
+}